@@ -0,0 +1,23 @@
+package reflectclient
+
+import (
+	"context"
+)
+
+type baseUrlKey struct{}
+
+// Return a context that sends requests made with it to baseUrl instead of the client's
+// base URL.
+func WithBaseUrl(ctx context.Context, baseUrl string) context.Context {
+	return context.WithValue(ctx, baseUrlKey{}, baseUrl)
+}
+
+// The base URL for a request, from its context if one was set there.
+func (c *Client) requestBaseUrl(ctx context.Context) string {
+	if ctx != nil {
+		if baseUrl, ok := ctx.Value(baseUrlKey{}).(string); ok {
+			return baseUrl
+		}
+	}
+	return c.baseUrl
+}
@@ -0,0 +1,15 @@
+package reflectclient
+
+import (
+	"reflect"
+)
+
+// A raw response body along with its metadata. Methods returning a Blob skip the
+// Unmarshaler entirely.
+type Blob struct {
+	Data        []byte
+	ContentType string
+	Length      int64
+}
+
+var blobType = reflect.TypeOf(Blob{})
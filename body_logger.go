@@ -0,0 +1,55 @@
+package reflectclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+type BodyLogger func(ctx context.Context, method string, body []byte)
+
+// Replace the values of the given fields in a JSON body with "[REDACTED]", at any depth.
+// Field names match case-insensitively. Bodies that aren't JSON are returned as is. For
+// use in a BodyLogger, e.g. logger(ctx, method, RedactJSONFields(body, "password")).
+func RedactJSONFields(body []byte, fields ...string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+
+	redacted, err := json.Marshal(redactValue(value, fields))
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+func redactValue(value interface{}, fields []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if inFold(k, fields) {
+				v[k] = "[REDACTED]"
+			} else {
+				v[k] = redactValue(e, fields)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactValue(e, fields)
+		}
+	}
+	return value
+}
+
+func inFold(needle string, haystack []string) bool {
+	for _, s := range haystack {
+		if strings.EqualFold(s, needle) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,3 @@
+package reflectclient
+
+type BodyRetryCheck func(body []byte) bool
@@ -0,0 +1,23 @@
+package reflectclient
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A byte range to request, sent as a Range header by fields with rc_feature:"range". A
+// negative End requests everything from Start on. A zero ByteRange sends no header, so use
+// ByteRange{0, 0} through a *ByteRange field to request just the first byte.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r ByteRange) String() string {
+	if r.End < 0 {
+		return fmt.Sprintf("bytes=%d-", r.Start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+var byteRangeType = reflect.TypeOf(ByteRange{})
@@ -0,0 +1,39 @@
+package reflectclient
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Options for a single call, passed as a *CallOptions argument to any method, e.g.
+//
+//	Get func(*GetArgs, *CallOptions) (*Thing, error) `rc_method:"GET" rc_path:"/things/{id}"`
+//
+// A nil *CallOptions is the same as an empty one.
+type CallOptions struct {
+	// Attached to the request, like a context.Context argument.
+	Context context.Context
+
+	// Added to the request's headers.
+	Header http.Header
+
+	// Limits the whole call, including retries and reading the response.
+	Timeout time.Duration
+}
+
+var callOptionsType = reflect.TypeOf((*CallOptions)(nil))
+
+// Apply a call's options to the request being built.
+func (opts *CallOptions) apply(rm *RequestMeta) {
+	if opts.Context != nil {
+		rm.ctx = opts.Context
+	}
+	for hn, hl := range opts.Header {
+		for _, h := range hl {
+			rm.headers.Add(hn, h)
+		}
+	}
+	rm.timeout = opts.Timeout
+}
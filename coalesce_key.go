@@ -0,0 +1,7 @@
+package reflectclient
+
+import (
+	"net/http"
+)
+
+type CoalesceKeyFunc func(req *http.Request) string
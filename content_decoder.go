@@ -0,0 +1,65 @@
+package reflectclient
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Decodes a response body sent with a Content-Encoding, e.g. br.
+type ContentDecoder func(io.Reader) (io.Reader, error)
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// The Accept-Encoding to send when the client has decoders. Setting it stops the
+// transport from decompressing gzip itself, so gzip is always accepted and decoded here.
+func (c *Client) acceptEncoding() string {
+	encodings := []string{"gzip"}
+	for encoding := range c.contentDecoders {
+		if encoding != "gzip" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	sort.Strings(encodings[1:])
+	return strings.Join(encodings, ", ")
+}
+
+// Replace the body of a response with a registered Content-Encoding with the decoded body.
+func (c *Client) decodeContent(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || resp.Request != nil && resp.Request.Method == "HEAD" {
+		return nil
+	}
+	decode, ok := c.contentDecoders[encoding]
+	if !ok && encoding == "gzip" && c.contentDecoders != nil {
+		decode = gunzip
+	}
+	if decode == nil {
+		return nil
+	}
+
+	r, err := decode(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = &decodedBody{r, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// Reads the decoded body and closes the original.
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,7 @@
+package reflectclient
+
+import (
+	"context"
+)
+
+type DecodeObserver func(ctx context.Context, method string, decoded interface{})
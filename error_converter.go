@@ -0,0 +1,8 @@
+package reflectclient
+
+// Convert an error into one of a method's custom error type, for errors that aren't
+// already of that type (e.g. transport failures, timeouts and marshal errors). The
+// result must be assignable to the type, or be wrapping a value that is (see errors.As).
+// Errors it returns nil or another type for are returned as its conversion of
+// ErrErrorConversion, which Init checks it can convert.
+type ErrorConverter func(err error) error
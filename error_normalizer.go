@@ -0,0 +1,3 @@
+package reflectclient
+
+type ErrorNormalizer func(status int, body []byte) error
@@ -0,0 +1,49 @@
+package reflectclient
+
+import (
+	"errors"
+)
+
+// Errors returned by Init and by service methods. Errors from service methods are
+// wrapped with the method name, so match them with errors.Is.
+var (
+	ErrReturnCount         = errors.New("Functions must return (T, error), (T, int, error) or error")
+	ErrSecondReturn        = errors.New("Second return value must be an error.")
+	ErrUnsupportedMethod   = errors.New("Unsupported method")
+	ErrMultipleBodies      = errors.New("Only one body per request is supported.")
+	ErrBodyAndFields       = errors.New("Requests cannot have form fields and an explicit body.")
+	ErrUnexpectedStatus    = errors.New("Unexpected status")
+	ErrTooManyRedirects    = errors.New("Too many redirects")
+	ErrMultipleOuts        = errors.New("Only one out field per request is supported.")
+	ErrOutNotPointer       = errors.New("Out fields must be pointers")
+	ErrReadTimeout         = errors.New("Timed out reading response body")
+	ErrNoMarshaler         = errors.New("No marshaler configured for body")
+	ErrUnsupportedFile     = errors.New("File fields must be []byte or io.Reader")
+	ErrUnknownMethod       = errors.New("Unknown method")
+	ErrInvalidHeader       = errors.New("Header fields cannot contain CR or LF")
+	ErrHeaderOutType       = errors.New("Header out fields must be *string or *[]string")
+	ErrQueryStructType     = errors.New("Query struct fields must be structs")
+	ErrInvalidHeaderTag    = errors.New("Header tags must look like \"Name: value\"")
+	ErrVariadicType        = errors.New("Variadic query values must be strings or fmt.Stringers")
+	ErrCookiesOutType      = errors.New("Cookie out fields must be []*http.Cookie")
+	ErrNoUnmarshaler       = errors.New("No unmarshaler configured for error type")
+	ErrMultipleBuffers     = errors.New("Only one buffer per request is supported.")
+	ErrBufferType          = errors.New("Buffer fields must be *bytes.Buffer")
+	ErrUnsupportedBody     = errors.New("Unsupported body type")
+	ErrInvalidProxy        = errors.New("Invalid proxy URL")
+	ErrNoReturnUnmarshaler = errors.New("No unmarshaler configured for non-[]byte return")
+	ErrUnknownPathToken    = errors.New("Path token has no matching argument or field")
+	ErrRawType             = errors.New("Raw fields must be []byte")
+	ErrRangeType           = errors.New("Range fields must be ByteRange or *ByteRange")
+	ErrMultipleRanges      = errors.New("Only one range per request is supported.")
+	ErrRequiredField       = errors.New("Required field is empty")
+	ErrStreamInterrupted   = errors.New("Stream ended before the response was complete")
+	ErrStatusReturn        = errors.New("Middle return value must be an int status code")
+	ErrStubType            = errors.New("Stubs must have the same type as the method they replace")
+	ErrNoErrorConverter    = errors.New("No error converter registered for error type")
+	ErrTrailingData        = errors.New("Unexpected data after the response value")
+	ErrUnknownFeature      = errors.New("Unknown field feature")
+	ErrDuplicateMethod     = errors.New("Embedded services cannot share a method name")
+	ErrErrorConversion     = errors.New("Error converter returned no value of the method's error type")
+	ErrBodyTooLarge        = errors.New("Response body is larger than the method's limit")
+)
@@ -0,0 +1,57 @@
+package reflectclient
+
+import (
+	"io"
+	"net/http"
+)
+
+// A captured request and response body pair. See Builder.CaptureExchanges.
+type Exchange struct {
+	Method   string
+	URL      string
+	Request  []byte
+	Status   int // 0 if there was no response
+	Response []byte
+}
+
+// Return the captured exchanges, oldest first.
+func (c *Client) Exchanges() []Exchange {
+	c.exchangesMu.Lock()
+	defer c.exchangesMu.Unlock()
+
+	return append([]Exchange(nil), c.exchanges...)
+}
+
+func (c *Client) recordExchange(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	exchange := Exchange{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Request:  append([]byte(nil), reqBody...),
+		Response: append([]byte(nil), respBody...),
+	}
+	if resp != nil {
+		exchange.Status = resp.StatusCode
+	}
+
+	c.exchangesMu.Lock()
+	defer c.exchangesMu.Unlock()
+
+	c.exchanges = append(c.exchanges, exchange)
+	if len(c.exchanges) > c.maxExchanges {
+		c.exchanges = c.exchanges[len(c.exchanges)-c.maxExchanges:]
+	}
+}
+
+// Copies everything read from a body into w.
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (r *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.w.Write(p[:n])
+	}
+	return n, err
+}
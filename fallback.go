@@ -0,0 +1,39 @@
+package reflectclient
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Whether a request failed in a way that suggests the server is down.
+func isServerFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// Send req once more against the fallback base URL, discarding the primary's response.
+// path is the request path relative to the base URL.
+func (c *Client) doFallback(req *http.Request, primary *http.Response, path string) (*http.Response, error) {
+	if primary != nil {
+		io.Copy(ioutil.Discard, primary.Body)
+		primary.Body.Close()
+	}
+
+	u, err := url.Parse(joinUrl(c.fallbackBaseUrl, path))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = req.URL.RawQuery
+	u.User = req.URL.User
+
+	fallback := req.Clone(req.Context())
+	fallback.URL = u
+	fallback.Host = ""
+	if req.GetBody != nil {
+		if fallback.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return c.httpClient.Do(fallback)
+}
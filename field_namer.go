@@ -0,0 +1,50 @@
+package reflectclient
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Map a Go field name to the name used on the wire, e.g. UserId to user_id.
+type FieldNamer func(goName string) string
+
+// How struct fields without an rc_name tag are named. A nil *fieldNaming uses Go names.
+type fieldNaming struct {
+	namer    FieldNamer
+	jsonTags bool
+}
+
+func (n *fieldNaming) name(field reflect.StructField) string {
+	if name := field.Tag.Get(TagName); name != "" {
+		return name
+	}
+	if n == nil {
+		return field.Name
+	}
+	if n.jsonTags {
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	if n.namer != nil {
+		return n.namer(field.Name)
+	}
+	return field.Name
+}
+
+// Name a field for each of n destinations. With more than one, rc_name can give a
+// comma separated name per destination, e.g. rc_name:"tenant,X-Tenant-Id".
+func (n *fieldNaming) names(field reflect.StructField, count int) []string {
+	names := make([]string, count)
+	if parts := strings.Split(field.Tag.Get(TagName), ","); count > 1 && len(parts) == count {
+		for i, part := range parts {
+			names[i] = strings.TrimSpace(part)
+		}
+	}
+	for i := range names {
+		if names[i] == "" {
+			names[i] = n.name(field)
+		}
+	}
+	return names
+}
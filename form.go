@@ -0,0 +1,143 @@
+package reflectclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// A file to upload as part of a multipart form.
+type formFile struct {
+	name     string
+	filename string
+	value    reflect.Value
+}
+
+// Collect the file fields of a struct. Files may be []byte or io.Reader. If the value has
+// a Name method (like *os.File) its base name is used as the filename, otherwise the
+// field name is.
+func collectFiles(value reflect.Value, nameMap map[string]*Arg, order []string) []formFile {
+	files := make([]formFile, 0)
+	for _, fn := range order {
+		n := nameMap[fn]
+		if !value.IsValid() {
+			continue
+		}
+		field := value.FieldByName(fn)
+		if isEmptyValue(field) {
+			continue
+		}
+
+		filename := n.Name
+		if named, ok := field.Interface().(interface{ Name() string }); ok {
+			filename = filepath.Base(named.Name())
+		}
+		files = append(files, formFile{n.Name, filename, field})
+	}
+	return files
+}
+
+// Encode fields and files as multipart/form-data, returning the body and its content type.
+func encodeMultipart(fields url.Values, files []formFile) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range fields[name] {
+			if err := w.WriteField(name, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	for _, file := range files {
+		part, err := w.CreateFormFile(file.name, file.filename)
+		if err != nil {
+			return nil, "", err
+		}
+		switch v := file.value.Interface().(type) {
+		case []byte:
+			_, err = part.Write(v)
+		case io.Reader:
+			_, err = io.Copy(part, v)
+		default:
+			err = ErrUnsupportedFile
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// Whether value is a slice of structs (or struct pointers), which is added as indexed keys.
+func isIndexedStructs(value reflect.Value) bool {
+	if !isRepeatable(value) {
+		return false
+	}
+	elem := value.Type().Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	return elem.Kind() == reflect.Struct
+}
+
+// Add value under indexed, bracketed keys, e.g. items[0][name]=x&items[1][name]=y. Struct
+// fields are named by rc_name, or their Go name, and nested slices and structs are
+// expanded the same way. Nil pointers and unexported fields are skipped.
+func addIndexed(adder FieldAdder, key string, value reflect.Value) error {
+	if _, ok := textMarshaler(value); ok {
+		return addFormatted(adder, key, value)
+	}
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch {
+	case value.Kind() == reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if err := addIndexed(adder, key+"["+(*fieldNaming)(nil).name(field)+"]", value.Field(i)); err != nil {
+				return err
+			}
+		}
+	case isRepeatable(value):
+		for i := 0; i < value.Len(); i++ {
+			if err := addIndexed(adder, fmt.Sprintf("%s[%d]", key, i), value.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return addFormatted(adder, key, value)
+	}
+	return nil
+}
+
+func addFormatted(adder FieldAdder, key string, value reflect.Value) error {
+	v, err := formatValue(value)
+	if err != nil {
+		return err
+	}
+	adder.Add(key, v)
+	return nil
+}
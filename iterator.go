@@ -0,0 +1,194 @@
+package reflectclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Splits a page of a paginated response into its encoded items, which are decoded into a
+// []T, and the cursor for the next page. An empty cursor ends the iteration.
+type CursorExtractor func(resp *http.Response, body []byte) (items []byte, cursor string, err error)
+
+// Builds the request for the page at cursor from the request for the previous page.
+type RequestRebuilder func(req *http.Request, cursor string) (*http.Request, error)
+
+// Without a CursorExtractor the whole body is a single page of items.
+func defaultCursorExtractor(resp *http.Response, body []byte) ([]byte, string, error) {
+	return body, "", nil
+}
+
+// Without a RequestRebuilder the cursor is sent as the "cursor" query value.
+func defaultRequestRebuilder(req *http.Request, cursor string) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	query := next.URL.Query()
+	query.Set("cursor", cursor)
+	next.URL.RawQuery = query.Encode()
+	return next, nil
+}
+
+// Iterates over the items of a paginated response, fetching each page when the items
+// before it have been used. Methods return one with a *Iterator[T] return, e.g.
+//
+//	List func(*ListArgs) (*Iterator[Thing], error) `rc_method:"GET" rc_path:"/things"`
+//
+// Pages are split with the client's CursorExtractor and requested with its
+// RequestRebuilder.
+type Iterator[T any] struct {
+	pages *pager
+	items []T
+	err   error
+}
+
+// Return the next item. The bool is false once all the items have been returned, or if
+// fetching or decoding a page failed.
+func (it *Iterator[T]) Next() (T, bool, error) {
+	var zero T
+	for len(it.items) == 0 {
+		if it.err != nil || it.pages.req == nil {
+			return zero, false, it.err
+		}
+		data, err := it.pages.next()
+		if err == nil {
+			err = it.pages.decode(data, &it.items)
+		}
+		if err != nil {
+			it.err = it.pages.meta.wrapError(err)
+		}
+	}
+
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, true, nil
+}
+
+func (it *Iterator[T]) setPager(p *pager) {
+	it.pages = p
+}
+
+// Implemented by every *Iterator[T], so methods can be set up without knowing T.
+type iterator interface {
+	setPager(*pager)
+}
+
+var iteratorType = reflect.TypeOf((*iterator)(nil)).Elem()
+
+// Fetches the pages of an Iterator.
+type pager struct {
+	client *Client
+	meta   *MethodMeta
+	ctx    context.Context // The caller's context, for hooks
+	req    *http.Request   // The next page, unprepared, nil after the last
+	body   []byte          // The request body, for the signer
+	path   string          // The request path, for the fallback
+	cancel func()          // Releases the request's context once the last page is fetched
+}
+
+// Fetch the next page and return its encoded items. Each page is prepared and sent like any
+// other request, and recorded in the stats, metrics and captured exchanges.
+func (p *pager) next() (items []byte, err error) {
+	c := p.client
+	req := p.req
+	p.req = nil
+
+	var resp *http.Response
+	counter := &countingReadCloser{}
+	start := time.Now()
+	defer func() {
+		if p.req == nil {
+			p.cancel()
+		}
+		elapsed := time.Since(start)
+		c.recordStats(p.meta, counter.n, elapsed)
+		if c.metricsObserver != nil {
+			var observed error
+			if err != nil {
+				observed = p.meta.wrapError(err)
+			}
+			c.observeMetrics(p.ctx, p.meta, resp, elapsed, observed)
+		}
+	}()
+
+	// Prepare a copy, so the next page is rebuilt from the unprepared request.
+	prepared, err := c.prepareRequest(req.Clone(req.Context()), p.body)
+	if err != nil {
+		return nil, err
+	}
+	var unauthed *http.Request
+	if c.unauthorizedHandler != nil {
+		unauthed = req
+	}
+	resp, err = c.send(p.meta, prepared, unauthed, p.body, p.path)
+
+	if resp != nil {
+		counter.ReadCloser = resp.Body
+		resp.Body = counter
+	}
+
+	if c.maxExchanges > 0 {
+		var captured bytes.Buffer
+		if resp != nil {
+			resp.Body = &teeReadCloser{resp.Body, &captured}
+		}
+		defer func() {
+			c.recordExchange(prepared, p.body, resp, captured.Bytes())
+		}()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := c.decodeContent(resp); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !isSuccessStatus(resp.StatusCode) {
+		return nil, c.statusError(resp, body)
+	}
+
+	extract := c.cursorExtractor
+	if extract == nil {
+		extract = defaultCursorExtractor
+	}
+	items, cursor, err := extract(resp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor != "" {
+		rebuild := c.requestRebuilder
+		if rebuild == nil {
+			rebuild = defaultRequestRebuilder
+		}
+		if p.req, err = rebuild(req, cursor); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Decode a page's items with the method's decoder or the client's Unmarshaler.
+func (p *pager) decode(data []byte, v interface{}) error {
+	if p.meta.decoder != nil {
+		return p.meta.decoder(data, v)
+	}
+	if p.client.unmarshaler == nil {
+		return ErrNoReturnUnmarshaler
+	}
+	return p.client.unmarshaler.Unmarshal(data, v)
+}
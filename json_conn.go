@@ -0,0 +1,47 @@
+package reflectclient
+
+import (
+	"golang.org/x/net/websocket"
+)
+
+// A WebSocket connection that sends and receives values as text frames, encoded with the
+// client's Marshaler and Unmarshaler (JSON for whichever isn't set).
+type JSONConn struct {
+	*websocket.Conn
+	codec websocket.Codec
+}
+
+// Wrap a connection returned by a WebSocket method in a JSONConn.
+func (c *Client) NewJSONConn(conn *websocket.Conn) *JSONConn {
+	var marshaler Marshaler = &JsonMarshaler{}
+	if c.marshaler != nil {
+		marshaler = c.marshaler
+	}
+	var unmarshaler Unmarshaler = &JsonUnmarshaler{}
+	if c.unmarshaler != nil {
+		unmarshaler = c.unmarshaler
+	}
+
+	return &JSONConn{
+		Conn: conn,
+		codec: websocket.Codec{
+			Marshal: func(v interface{}) ([]byte, byte, error) {
+				data, err := marshaler.Marshal(v)
+				return data, websocket.TextFrame, err
+			},
+			Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+				return unmarshaler.Unmarshal(data, v)
+			},
+		},
+	}
+}
+
+// Encode v and send it as a single frame.
+func (jc *JSONConn) Send(v interface{}) error {
+	return jc.codec.Send(jc.Conn, v)
+}
+
+// Receive a single frame and decode it into v, which must be a pointer.
+func (jc *JSONConn) Receive(v interface{}) error {
+	return jc.codec.Receive(jc.Conn, v)
+}
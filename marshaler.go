@@ -0,0 +1,24 @@
+package reflectclient
+
+import (
+	"encoding/json"
+	"gopkg.in/yaml.v3"
+)
+
+type Marshaler interface {
+	Marshal(interface{}) ([]byte, error)
+}
+
+type JsonMarshaler struct {
+}
+
+func (m *JsonMarshaler) Marshal(obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+type YamlMarshaler struct {
+}
+
+func (m *YamlMarshaler) Marshal(obj interface{}) ([]byte, error) {
+	return yaml.Marshal(obj)
+}
@@ -0,0 +1,32 @@
+package reflectclient
+
+import (
+	"context"
+)
+
+type metadataKey struct{}
+
+// Return a context carrying key and value as metadata for calls made with it. Metadata
+// isn't sent; it's for hooks to read with Metadata, like the BodyLogger, MetricsObserver
+// and DecodeObserver, or RequestTransformers through the request's context.
+func WithMetadata(ctx context.Context, key string, value interface{}) context.Context {
+	md := make(map[string]interface{})
+	for k, v := range Metadata(ctx) {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// Return a copy of the metadata set on ctx with WithMetadata, or nil if there is none.
+func Metadata(ctx context.Context) map[string]interface{} {
+	md, ok := ctx.Value(metadataKey{}).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(md))
+	for k, v := range md {
+		copied[k] = v
+	}
+	return copied
+}
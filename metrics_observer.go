@@ -0,0 +1,8 @@
+package reflectclient
+
+import (
+	"context"
+	"time"
+)
+
+type MetricsObserver func(ctx context.Context, method string, status int, elapsed time.Duration, err error)
@@ -0,0 +1,54 @@
+package reflectclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+func isCallbackType(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Func &&
+		typ.NumIn() == 1 &&
+		typ.NumOut() == 1 &&
+		typ.Out(0) == errorType
+}
+
+// Decode a newline delimited stream of values, passing each to callback as it arrives.
+// Reads until EOF, so chunked responses without a Content-Length work. Stops at the end
+// of the stream or at the first error, including one returned by the callback. If the
+// connection closes early the partial line is dropped and ErrStreamInterrupted returned.
+func (c *Client) streamNDJSON(body io.Reader, callback reflect.Value) error {
+	var unmarshaler Unmarshaler = &JsonUnmarshaler{}
+	if c.unmarshaler != nil {
+		unmarshaler = c.unmarshaler
+	}
+
+	valueType := callback.Type().In(0)
+	reader := bufio.NewReader(body)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			if errors.Is(readErr, ErrReadTimeout) {
+				return readErr
+			}
+			return fmt.Errorf("%w: %s", ErrStreamInterrupted, readErr)
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			instance := reflect.New(valueType)
+			if err := unmarshaler.Unmarshal(line, instance.Interface()); err != nil {
+				return err
+			}
+			if err := returnedError(callback.Call([]reflect.Value{instance.Elem()})[0]); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package reflectclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Issue a GET to the client's base URL joined with path, returning an error if the
+// server can't be reached or doesn't respond with a 2xx status. Useful for readiness probes.
+// The request gets the client's credentials, transformers and signer, like any other.
+func (c *Client) Ping(ctx context.Context, path string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", joinUrl(c.baseUrl, path), nil)
+	if err != nil {
+		return err
+	}
+	if c.userInfo != nil {
+		req.URL.User = c.userInfo
+	}
+	if req, err = c.prepareRequest(req, nil); err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if !isSuccessStatus(resp.StatusCode) {
+		return fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+	}
+	return nil
+}
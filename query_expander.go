@@ -0,0 +1,40 @@
+package reflectclient
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+)
+
+type QueryExpander func(v reflect.Value, q url.Values)
+
+// Expand a query field with the expander registered for its type, if there is one.
+// Returns false if the field should be added as usual.
+func expandQueryField(field reflect.Value, adder FieldAdder, expanders map[reflect.Type]QueryExpander) bool {
+	expand, ok := expanders[field.Type()]
+	if !ok && field.Kind() == reflect.Ptr {
+		if expand, ok = expanders[field.Type().Elem()]; ok {
+			if field.IsNil() {
+				return true
+			}
+			field = field.Elem()
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	values := url.Values{}
+	expand(field, values)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range values[k] {
+			adder.Add(k, v)
+		}
+	}
+	return true
+}
@@ -1,13 +1,30 @@
 package reflectclient
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNonFunctionField(t *testing.T) {
@@ -21,6 +38,25 @@ func TestNonFunctionField(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestUntaggedFunctionField(t *testing.T) {
+	type TestService struct {
+		Manual    func(string) string
+		Generated func() (interface{}, error) `rc_method:"GET" rc_path:"/test"`
+	}
+	manual := func(s string) string { return "manual " + s }
+	service := &TestService{Manual: manual}
+
+	client, _ := NewBuilder().Build()
+	err := client.Init(service)
+	assert.Nil(t, err)
+	assert.NotNil(t, service.Generated)
+	assert.Equal(t, service.Manual("call"), "manual call")
+
+	unset := &TestService{}
+	assert.Nil(t, client.Init(unset))
+	assert.Nil(t, unset.Manual)
+}
+
 func TestReturnValueCount(t *testing.T) {
 	type TestService1 struct {
 		NoReturnArgs func() `rc_method:"GET"`
@@ -32,10 +68,10 @@ func TestReturnValueCount(t *testing.T) {
 		TwoReturnArgs func() (int, error) `rc_method:"GET"`
 	}
 	type TestService4 struct {
-		ThreeReturnArgs func() (int, int, error) `rc_method:"GET"`
+		FourReturnArgs func() (int, int, int, error) `rc_method:"GET"`
 	}
 
-	client, _ := NewBuilder().BaseUrl("http://localhost").Build()
+	client, _ := NewBuilder().BaseUrl("http://localhost").SetUnmarshaler(&JsonUnmarshaler{}).Build()
 
 	service1 := new(TestService1)
 	err := client.Init(service1)
@@ -97,10 +133,10 @@ func TestApplyPathFields(t *testing.T) {
 
 	value := reflect.ValueOf(arg)
 
-	sm, _ := processStructArg(value.Type())
+	sm, _ := processStructArg(value.Type(), nil)
 	path := "/pre/{id}/post"
 
-	path = applyPathFields(value, path, sm.pathFields)
+	path = applyPathFields(value, path, sm.pathFields, sm.pathOrder)
 	assert.Equal(t, path, "/pre/1234/post")
 }
 
@@ -115,13 +151,96 @@ func TestApplyAdderFields(t *testing.T) {
 
 	value := reflect.ValueOf(arg)
 
-	sm, _ := processStructArg(value.Type())
+	sm, _ := processStructArg(value.Type(), nil)
 	v := url.Values{}
 
-	applyAdderFields(value, v, sm.queryFields)
+	applyAdderFields(value, v, sm.queryFields, sm.queryOrder, nil)
 	assert.Equal(t, v.Get("id"), "1234")
 }
 
+func TestApplyAdderFieldsBrackets(t *testing.T) {
+	type TestArg struct {
+		Tags []string `rc_feature:"query" rc_name:"tags" rc_options:"brackets"`
+		Ids  []int    `rc_feature:"query" rc_name:"id"`
+	}
+
+	arg := TestArg{
+		Tags: []string{"a", "b"},
+		Ids:  []int{1, 2},
+	}
+
+	value := reflect.ValueOf(arg)
+
+	sm, _ := processStructArg(value.Type(), nil)
+	v := url.Values{}
+
+	applyAdderFields(value, v, sm.queryFields, sm.queryOrder, nil)
+	assert.Equal(t, v["tags[]"], []string{"a", "b"})
+	assert.Equal(t, v["id"], []string{"1", "2"})
+	assert.Equal(t, v.Encode(), "id=1&id=2&tags%5B%5D=a&tags%5B%5D=b")
+}
+
+func TestApplyAdderFieldsMap(t *testing.T) {
+	type TestArg struct {
+		Headers map[string]string `rc_feature:"header"`
+	}
+
+	arg := TestArg{
+		Headers: map[string]string{
+			"X-Tenant":  "acme",
+			"X-Request": "1234",
+		},
+	}
+
+	value := reflect.ValueOf(arg)
+
+	sm, _ := processStructArg(value.Type(), nil)
+	h := http.Header{}
+
+	applyAdderFields(value, h, sm.headerFields, sm.headerOrder, nil)
+	assert.Equal(t, len(h), 2)
+	assert.Equal(t, h.Get("X-Tenant"), "acme")
+	assert.Equal(t, h.Get("X-Request"), "1234")
+}
+
+func TestApplyAdderFieldsReplace(t *testing.T) {
+	type DefaultArg struct {
+		Accept string `rc_feature:"header" rc_name:"Accept" rc_options:"omitempty"`
+		Mode   string `rc_feature:"header" rc_name:"X-Mode"`
+	}
+	type OverrideArg struct {
+		Accept string `rc_feature:"header" rc_name:"Accept" rc_options:"replace"`
+		Mode   string `rc_feature:"header" rc_name:"X-Mode"`
+	}
+
+	defaults := reflect.ValueOf(DefaultArg{Accept: "text/plain", Mode: "a"})
+	overrides := reflect.ValueOf(OverrideArg{Accept: "application/json", Mode: "b"})
+	dsm, _ := processStructArg(defaults.Type(), nil)
+	osm, _ := processStructArg(overrides.Type(), nil)
+
+	h := http.Header{}
+	applyAdderFields(defaults, h, dsm.headerFields, dsm.headerOrder, nil)
+	applyAdderFields(overrides, h, osm.headerFields, osm.headerOrder, nil)
+
+	assert.Equal(t, h["Accept"], []string{"application/json"})
+	assert.Equal(t, h["X-Mode"], []string{"a", "b"})
+}
+
+func TestJoinUrl(t *testing.T) {
+	assert.Equal(t, joinUrl("http://host", "/users"), "http://host/users")
+	assert.Equal(t, joinUrl("http://host/", "/users"), "http://host/users")
+	assert.Equal(t, joinUrl("http://host/api/", "users"), "http://host/api/users")
+	assert.Equal(t, joinUrl("http://host/api", ""), "http://host/api")
+	assert.Equal(t, joinUrl("http://host/api", "?q=1"), "http://host/api?q=1")
+}
+
+func TestTagValues(t *testing.T) {
+	tag := reflect.StructTag(`rc_method:"GET" rc_header:"A: 1" rc_path:"/x" rc_header:"B: \"2\""`)
+	assert.Equal(t, tagValues(tag, "rc_header"), []string{"A: 1", `B: "2"`})
+	assert.Equal(t, tagValues(tag, "rc_path"), []string{"/x"})
+	assert.Len(t, tagValues(tag, "rc_missing"), 0)
+}
+
 func TestApplyPathIndex(t *testing.T) {
 	path := "/{0}/{2}/{1}"
 	path = applyPathIndex(reflect.ValueOf("a"), path, 0)
@@ -143,7 +262,7 @@ func TestProcessStructArg(t *testing.T) {
 	args := &TestArgs{}
 	argsType := reflect.TypeOf(args).Elem()
 
-	sm, _ := processStructArg(argsType)
+	sm, _ := processStructArg(argsType, nil)
 	assert.Equal(t, sm.pathFields["Path"].Name, "path1")
 	assert.Equal(t, sm.formFields["Field"].Name, "field1")
 	assert.Equal(t, sm.queryFields["Query"].Name, "query1")
@@ -151,6 +270,28 @@ func TestProcessStructArg(t *testing.T) {
 	assert.Equal(t, sm.bodyField.Name, "Body")
 }
 
+func TestProcessStructArgOrder(t *testing.T) {
+	type TestArgs struct {
+		Z      string `rc_feature:"query"`
+		Header string `rc_feature:"header"`
+		A      string `rc_feature:"query"`
+		Path2  string `rc_feature:"path"`
+		M      string `rc_feature:"query"`
+		Field  string `rc_feature:"field"`
+		Path1  string `rc_feature:"path"`
+	}
+
+	sm, _ := processStructArg(reflect.TypeOf(TestArgs{}), nil)
+	assert.Equal(t, sm.queryOrder, []string{"Z", "A", "M"})
+	assert.Equal(t, sm.pathOrder, []string{"Path2", "Path1"})
+	assert.Equal(t, sm.headerOrder, []string{"Header"})
+	assert.Equal(t, sm.formOrder, []string{"Field"})
+
+	v := newOrderedValues()
+	applyAdderFields(reflect.ValueOf(TestArgs{Z: "1", A: "2", M: "3"}), v, sm.queryFields, sm.queryOrder, nil)
+	assert.Equal(t, v.Encode(), "Z=1&A=2&M=3")
+}
+
 func TestBodyAndFieldArgs(t *testing.T) {
 	type FieldArg struct {
 		Field string `rc_feature:"field" rc_name:"field"`
@@ -204,7 +345,7 @@ func TestProcessStructArgNoName(t *testing.T) {
 	args := &TestArgs{}
 	argsType := reflect.TypeOf(args).Elem()
 
-	sm, _ := processStructArg(argsType)
+	sm, _ := processStructArg(argsType, nil)
 	arg := sm.formFields["Field"]
 	assert.Equal(t, arg.Name, "Field")
 }
@@ -226,16 +367,4124 @@ func TestApplyRequestTransformers(t *testing.T) {
 	assert.Equal(t, q.Get("one"), "1")
 }
 
-func TestWebSocketInit(t *testing.T) {
-	type WebSocketStruct struct {
-		WSRequest func() (*websocket.Conn, error) `rc_method:"GET" origin:"https://www.websocket.org" path:"/echo"`
+func TestTraceHeaderInjector(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Call func() ([]byte, error) `rc_method:"GET" rc_path:"/trace"`
+	}
+
+	injected := false
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetTraceHeaderInjector(func(ctx context.Context, h http.Header) {
+			injected = ctx != nil
+			h.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		}).
+		Build()
+
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Call()
+	assert.Nil(t, err)
+	assert.True(t, injected)
+	assert.Equal(t, traceparent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+}
+
+func TestMetricsObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		CreateUser func(context.Context) ([]byte, error) `rc_method:"POST" rc_path:"/users"`
+	}
+
+	var observedCtx context.Context
+	var observedMethod string
+	var observedStatus int
+	var observedErr error
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetMetricsObserver(func(ctx context.Context, method string, status int, elapsed time.Duration, err error) {
+			observedCtx = ctx
+			observedMethod = method
+			observedStatus = status
+			observedErr = err
+		}).
+		Build()
+
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	ctx := WithMetadata(context.Background(), "route", "users")
+	_, err := service.CreateUser(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, Metadata(observedCtx), map[string]interface{}{"route": "users"})
+	assert.Equal(t, observedMethod, "CreateUser")
+	assert.Equal(t, observedStatus, http.StatusCreated)
+	assert.Nil(t, observedErr)
+}
+
+func TestErrorIncludesMethodName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	type TestService struct {
+		FetchUser func() ([]byte, error) `rc_method:"GET" rc_path:"/user"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.FetchUser()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "FetchUser: "))
+}
+
+func TestBuildRequestMetaErrorIncludesMethodName(t *testing.T) {
+	type FieldArg struct {
+		Field string `rc_feature:"field" rc_name:"field"`
+	}
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+
+	fieldMeta, _ := processStructArg(reflect.TypeOf(FieldArg{}), nil)
+	bodyMeta, _ := processStructArg(reflect.TypeOf(BodyArg{}), nil)
+	meta := &MethodMeta{
+		name:   "Upload",
+		method: "POST",
+		methodArgs: []MethodArg{
+			{isStruct: true, structMeta: fieldMeta},
+			{isStruct: true, structMeta: bodyMeta},
+		},
+	}
+
+	_, err := buildRequestMeta(meta, []reflect.Value{
+		reflect.ValueOf(&FieldArg{Field: "value"}),
+		reflect.ValueOf(&BodyArg{Body: []byte("body")}),
+	})
+	assert.Equal(t, err.Error(), "Upload: Requests cannot have form fields and an explicit body.")
+}
+
+func TestSentinelErrors(t *testing.T) {
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type FieldArg struct {
+		Field string `rc_feature:"field"`
+	}
+	type UnsupportedService struct {
+		Call func() ([]byte, error) `rc_method:"BOGUS"`
+	}
+	type ReturnCountService struct {
+		Call func() error `rc_method:"GET"`
+	}
+	type SecondReturnService struct {
+		Call func() ([]byte, int) `rc_method:"GET"`
+	}
+	type MultipleBodiesService struct {
+		Call func(*BodyArg, *BodyArg) ([]byte, error) `rc_method:"POST"`
+	}
+	type BodyAndFieldsService struct {
+		Call func(*BodyArg, *FieldArg) ([]byte, error) `rc_method:"POST"`
 	}
 
 	client, _ := NewBuilder().Build()
-	service := &WebSocketStruct{}
+	assert.True(t, errors.Is(client.Init(&UnsupportedService{}), ErrUnsupportedMethod))
+	assert.True(t, errors.Is(client.Init(&ReturnCountService{}), ErrReturnCount))
+	assert.True(t, errors.Is(client.Init(&SecondReturnService{}), ErrSecondReturn))
+	assert.True(t, errors.Is(client.Init(&MultipleBodiesService{}), ErrMultipleBodies))
+	assert.True(t, errors.Is(client.Init(&BodyAndFieldsService{}), ErrBodyAndFields))
 
-	err := client.Init(service)
+	fieldMeta, _ := processStructArg(reflect.TypeOf(FieldArg{}), nil)
+	bodyMeta, _ := processStructArg(reflect.TypeOf(BodyArg{}), nil)
+	meta := &MethodMeta{
+		name:   "Call",
+		method: "POST",
+		methodArgs: []MethodArg{
+			{isStruct: true, structMeta: fieldMeta},
+			{isStruct: true, structMeta: bodyMeta},
+		},
+	}
+	_, err := buildRequestMeta(meta, []reflect.Value{
+		reflect.ValueOf(&FieldArg{Field: "value"}),
+		reflect.ValueOf(&BodyArg{Body: []byte("body")}),
+	})
+	assert.True(t, errors.Is(err, ErrBodyAndFields))
+}
+
+func TestSingleFlight(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte("shared"))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Call func() ([]byte, error) `rc_method:"GET" rc_path:"/resource"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).EnableSingleFlight().Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	const calls = 10
+	var wg sync.WaitGroup
+	results := make([][]byte, calls)
+	errs := make([]error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = service.Call()
+		}(i)
+	}
+
+	// Give every call a chance to join the in-flight request before the server answers.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&hits), int32(1))
+	for i := 0; i < calls; i++ {
+		assert.Nil(t, errs[i])
+		assert.Equal(t, string(results[i]), "shared")
+	}
+}
+
+func TestSingleFlightGzip(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"name":"shared"}`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Call func() (*Thing, error) `rc_method:"GET" rc_path:"/resource"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		RegisterDecoder("br", func(r io.Reader) (io.Reader, error) { return r, nil }).
+		EnableSingleFlight().
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// Each caller decodes its own copy of the shared response.
+	const calls = 10
+	var wg sync.WaitGroup
+	results := make([]*Thing, calls)
+	errs := make([]error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = service.Call()
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&hits), int32(1))
+	for i := 0; i < calls; i++ {
+		assert.Nil(t, errs[i])
+		if results[i] != nil {
+			assert.Equal(t, results[i].Name, "shared")
+		}
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte("for " + r.Header.Get("X-User")))
+	}))
+	defer server.Close()
+
+	type UserArg struct {
+		User string `rc_feature:"header" rc_name:"X-User" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Call func(*UserArg) ([]byte, error) `rc_method:"GET" rc_path:"/resource"`
+	}
+
+	// Responses are scoped to the user, so the same URL is only shared within a user.
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetCoalesceKey(func(r *http.Request) string {
+			if user := r.Header.Get("X-User"); user != "" {
+				return user + " " + r.URL.String()
+			}
+			return ""
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	users := []string{"a", "a", "a", "b", "b", "b", "", ""}
+	var wg sync.WaitGroup
+	results := make([][]byte, len(users))
+	errs := make([]error, len(users))
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user string) {
+			defer wg.Done()
+			results[i], errs[i] = service.Call(&UserArg{User: user})
+		}(i, user)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// One call each for a and b, and one for each request without a key.
+	assert.Equal(t, atomic.LoadInt32(&hits), int32(4))
+	for i, user := range users {
+		assert.Nil(t, errs[i])
+		assert.Equal(t, string(results[i]), "for "+user)
+	}
+}
+
+type binaryMessage struct {
+	Id   byte
+	Text string
+}
+
+func (m *binaryMessage) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty message")
+	}
+	m.Id = data[0]
+	m.Text = string(data[1:])
+	return nil
+}
+
+func TestBinaryUnmarshalerReturn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{7, 'h', 'i'})
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Value   func() (binaryMessage, error)  `rc_method:"GET" rc_path:"/message"`
+		Pointer func() (*binaryMessage, error) `rc_method:"GET" rc_path:"/message"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	value, err := service.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, value, binaryMessage{Id: 7, Text: "hi"})
+
+	pointer, err := service.Pointer()
+	assert.Nil(t, err)
+	assert.Equal(t, *pointer, binaryMessage{Id: 7, Text: "hi"})
+}
+
+func TestDefaultContentType(t *testing.T) {
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TypedBodyArg struct {
+		ContentType string `rc_feature:"header" rc_name:"Content-Type"`
+		Body        []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Post      func(*BodyArg) ([]byte, error)      `rc_method:"POST" rc_path:"/post"`
+		PostTyped func(*TypedBodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/post"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetDefaultContentType("application/json").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Post(&BodyArg{Body: []byte(`{}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, contentType, "application/json")
+
+	_, err = service.PostTyped(&TypedBodyArg{ContentType: "text/plain", Body: []byte("text")})
+	assert.Nil(t, err)
+	assert.Equal(t, contentType, "text/plain")
+}
+
+func TestOrderedQuery(t *testing.T) {
+	var rawQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+	}))
+	defer server.Close()
+
+	type SignedArgs struct {
+		Timestamp string `rc_feature:"query" rc_name:"timestamp"`
+		Action    string `rc_feature:"query" rc_name:"action"`
+		Key       string `rc_feature:"query" rc_name:"key"`
+	}
+	type TestService struct {
+		Sorted  func(*SignedArgs) ([]byte, error) `rc_method:"GET" rc_path:"/sign?v=1"`
+		Ordered func(*SignedArgs) ([]byte, error) `rc_method:"GET" rc_path:"/sign?v=1" rc_options:"orderedquery"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	args := &SignedArgs{Timestamp: "100", Action: "list items", Key: "k"}
+
+	_, err := service.Sorted(args)
+	assert.Nil(t, err)
+	assert.Equal(t, rawQuery, "action=list+items&key=k&timestamp=100&v=1")
+
+	_, err = service.Ordered(args)
+	assert.Nil(t, err)
+	assert.Equal(t, rawQuery, "v=1&timestamp=100&action=list+items&key=k")
+}
+
+func TestGzipThreshold(t *testing.T) {
+	var encoding string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		var body io.Reader = r.Body
+		if encoding == "gzip" {
+			body, _ = gzip.NewReader(r.Body)
+		}
+		received, _ = ioutil.ReadAll(body)
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Upload func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/upload" rc_options:"gzip=1024"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	small := []byte("small body")
+	_, err := service.Upload(&BodyArg{Body: small})
+	assert.Nil(t, err)
+	assert.Equal(t, encoding, "")
+	assert.Equal(t, received, small)
+
+	large := bytes.Repeat([]byte("large body "), 200)
+	_, err = service.Upload(&BodyArg{Body: large})
+	assert.Nil(t, err)
+	assert.Equal(t, encoding, "gzip")
+	assert.Equal(t, received, large)
+}
+
+func TestGzipInvalidThreshold(t *testing.T) {
+	type TestService struct {
+		Upload func() ([]byte, error) `rc_method:"POST" rc_options:"gzip=big"`
+	}
+
+	client, _ := NewBuilder().Build()
+	err := client.Init(&TestService{})
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid gzip size: "))
+}
+
+func TestPing(t *testing.T) {
+	status := http.StatusOK
+	var pinged string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pinged = r.URL.Path
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+
+	assert.Nil(t, client.Ping(context.Background(), "/healthz"))
+	assert.Equal(t, pinged, "/healthz")
+
+	status = http.StatusServiceUnavailable
+	err := client.Ping(context.Background(), "/healthz")
+	assert.True(t, errors.Is(err, ErrUnexpectedStatus))
+	assert.Equal(t, err.Error(), "Unexpected status: 503")
+}
+
+func TestPingAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "admin" || password != "secret" || r.Header.Get("X-Signature") != "GET /healthz" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUserInfo("admin", "secret").
+		SetRequestSigner(func(req *http.Request, body []byte) error {
+			req.Header.Set("X-Signature", req.Method+" "+req.URL.Path)
+			return nil
+		}).
+		Build()
+	assert.Nil(t, client.Ping(context.Background(), "/healthz"))
+
+	failed := errors.New("no key")
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		SetRequestSigner(func(req *http.Request, body []byte) error { return failed }).
+		Build()
+	assert.ErrorIs(t, client.Ping(context.Background(), "/healthz"), failed)
+}
+
+func TestBlobReturn(t *testing.T) {
+	data := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Download func() (Blob, error) `rc_method:"GET" rc_path:"/image.png"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	blob, err := service.Download()
+	assert.Nil(t, err)
+	assert.Equal(t, blob.Data, data)
+	assert.Equal(t, blob.ContentType, "image/png")
+	assert.Equal(t, blob.Length, int64(len(data)))
+}
+
+func TestPatchContentTypes(t *testing.T) {
+	var method, contentType string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		contentType = r.Header.Get("Content-Type")
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	type PatchArg struct {
+		Id   int    `rc_feature:"path" rc_name:"id"`
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		MergePatch func(*PatchArg) ([]byte, error) `rc_method:"PATCH" rc_path:"/users/{id}" rc_options:"mergepatch"`
+		JsonPatch  func(*PatchArg) ([]byte, error) `rc_method:"PATCH" rc_path:"/users/{id}" rc_options:"jsonpatch"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetDefaultContentType("application/json").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.MergePatch(&PatchArg{Id: 1, Body: []byte(`{"name":"new"}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, method, "PATCH")
+	assert.Equal(t, contentType, "application/merge-patch+json")
+	assert.Equal(t, string(received), `{"name":"new"}`)
+
+	_, err = service.JsonPatch(&PatchArg{Id: 1, Body: []byte(`[{"op":"remove","path":"/name"}]`)})
 	assert.Nil(t, err)
+	assert.Equal(t, contentType, "application/json-patch+json")
+	assert.Equal(t, string(received), `[{"op":"remove","path":"/name"}]`)
+}
+
+type APIError interface {
+	error
+	Code() int
+}
+
+type apiError struct {
+	code int
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("api error %d", e.code) }
+func (e *apiError) Code() int     { return e.code }
+
+type apiErrorUnmarshaler struct{}
+
+func (u *apiErrorUnmarshaler) Unmarshal(in []byte, obj interface{}) error {
+	if string(in) == "bad" {
+		return &apiError{code: 42}
+	}
+	return json.Unmarshal(in, obj)
+}
+
+func TestCustomErrorReturn(t *testing.T) {
+	body := `{"name":"test"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	type Resp struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get func() (Resp, APIError) `rc_method:"GET" rc_path:"/resp"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&apiErrorUnmarshaler{}).
+		Build()
+	assert.ErrorIs(t, client.Init(&TestService{}), ErrNoErrorConverter)
+
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&apiErrorUnmarshaler{}).
+		RegisterErrorConverter(reflect.TypeOf((*APIError)(nil)).Elem(), func(err error) error {
+			return &apiError{code: -1}
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	resp, apiErr := service.Get()
+	assert.Nil(t, apiErr)
+	assert.Equal(t, resp.Name, "test")
+
+	body = "bad"
+	_, apiErr = service.Get()
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, apiErr.Code(), 42)
+
+	// Transport failures go through the converter rather than panicking.
+	server.Close()
+	_, apiErr = service.Get()
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, apiErr.Code(), -1)
+
+	// Errors the converter returns nil for come back as its conversion of ErrErrorConversion.
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&apiErrorUnmarshaler{}).
+		RegisterErrorConverter(reflect.TypeOf((*APIError)(nil)).Elem(), func(err error) error {
+			if errors.Is(err, ErrErrorConversion) {
+				return &apiError{code: -2}
+			}
+			return nil
+		}).
+		Build()
+	assert.Nil(t, client.Init(service))
+	_, apiErr = service.Get()
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, apiErr.Code(), -2)
+
+	// Converters must at least handle ErrErrorConversion.
+	client, _ = NewBuilder().
+		RegisterErrorConverter(reflect.TypeOf((*APIError)(nil)).Elem(), func(err error) error { return nil }).
+		Build()
+	assert.ErrorIs(t, client.Init(&TestService{}), ErrErrorConversion)
+}
+
+func TestHeadContentLength(t *testing.T) {
+	var method string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Length", "123456")
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Size func() (int64, error) `rc_method:"HEAD" rc_path:"/file"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	size, err := service.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, method, "HEAD")
+	assert.Equal(t, size, int64(123456))
+}
+
+func TestMaxRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/new":
+			w.Write([]byte("moved"))
+		}
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/old"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetMaxRedirects(1).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "moved")
+
+	client, _ = NewBuilder().BaseUrl(server.URL).DisableRedirects().Build()
+	service = &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err = service.Get()
+	assert.True(t, errors.Is(err, ErrTooManyRedirects))
+}
+
+func TestNDJSONCallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"line":1,"message":"starting"}`+"\n")
+		io.WriteString(w, `{"line":2,"message":"running"}`+"\n\n")
+		io.WriteString(w, `{"line":3,"message":"done"}`)
+	}))
+	defer server.Close()
+
+	type LogLine struct {
+		Line    int    `json:"line"`
+		Message string `json:"message"`
+	}
+	type TailArgs struct {
+		Service string `rc_feature:"path" rc_name:"service"`
+	}
+	type TestService struct {
+		Tail func(context.Context, *TailArgs, func(LogLine) error) error `rc_method:"GET" rc_path:"/logs/{service}"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// The callback is the only destination for the response, so the method only returns an error.
+	ctx := context.Background()
+	var lines []LogLine
+	err := service.Tail(ctx, &TailArgs{Service: "api"}, func(line LogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, lines, []LogLine{{1, "starting"}, {2, "running"}, {3, "done"}})
+
+	stop := errors.New("stop")
+	lines = nil
+	err = service.Tail(ctx, &TailArgs{Service: "api"}, func(line LogLine) error {
+		lines = append(lines, line)
+		return stop
+	})
+	assert.True(t, errors.Is(err, stop))
+	assert.Len(t, lines, 1)
+}
+
+func TestOutField(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":7,"name":"user"}`))
+	}))
+	defer server.Close()
+
+	type User struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	type GetUserArgs struct {
+		Id  int   `rc_feature:"path" rc_name:"id"`
+		Out *User `rc_feature:"out"`
+	}
+	type TestService struct {
+		GetUser func(*GetUserArgs) error `rc_method:"GET" rc_path:"/users/{id}"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	user := &User{}
+	err := service.GetUser(&GetUserArgs{Id: 7, Out: user})
+	assert.Nil(t, err)
+	assert.Equal(t, *user, User{Id: 7, Name: "user"})
+
+	args := &GetUserArgs{Id: 7}
+	assert.Nil(t, service.GetUser(args))
+	assert.Equal(t, *args.Out, User{Id: 7, Name: "user"})
+}
+
+func TestOutFieldRequired(t *testing.T) {
+	type TestService struct {
+		Call func() error `rc_method:"GET"`
+	}
+
+	client, _ := NewBuilder().Build()
+	err := client.Init(&TestService{})
+	assert.True(t, errors.Is(err, ErrReturnCount))
+}
+
+func TestRequestSigner(t *testing.T) {
+	var signature string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("Authorization")
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Post func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/signed"`
+	}
+
+	sign := func(method, path string, body []byte) string {
+		sum := sha256.Sum256(append([]byte(method+path), body...))
+		return "HMAC " + hex.EncodeToString(sum[:])
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetRequestSigner(func(req *http.Request, body []byte) error {
+			req.Header.Set("Authorization", sign(req.Method, req.URL.Path, body))
+			return nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Post(&BodyArg{Body: []byte("payload")})
+	assert.Nil(t, err)
+	assert.Equal(t, signature, sign("POST", "/signed", []byte("payload")))
+	assert.Equal(t, string(received), "payload")
+
+	failed := errors.New("no key")
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		SetRequestSigner(func(req *http.Request, body []byte) error { return failed }).
+		Build()
+	assert.Nil(t, client.Init(service))
+
+	_, err = service.Post(&BodyArg{Body: []byte("payload")})
+	assert.True(t, errors.Is(err, failed))
+}
+
+func TestOptionsAllow(t *testing.T) {
+	var method string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Allow", "GET, POST")
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Allowed func() ([]string, error) `rc_method:"OPTIONS" rc_path:"/users"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	allowed, err := service.Allowed()
+	assert.Nil(t, err)
+	assert.Equal(t, method, "OPTIONS")
+	assert.Equal(t, allowed, []string{"GET", "POST"})
+}
+
+func TestStreamReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"n":1}`+"\n")
+		w.(http.Flusher).Flush()
+		// Stall the next chunk.
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	type Event struct {
+		N int `json:"n"`
+	}
+	type TestService struct {
+		Events func(func(Event) error) ([]byte, error) `rc_method:"GET" rc_path:"/events"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetStreamReadTimeout(50 * time.Millisecond).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	var events []Event
+	_, err := service.Events(func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrReadTimeout))
+	assert.Equal(t, events, []Event{{1}})
+}
+
+func TestUserInfo(t *testing.T) {
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/legacy"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUserInfo("user", "s3cret").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, username, "user")
+	assert.Equal(t, password, "s3cret")
+	assert.False(t, strings.Contains(client.baseUrl, "s3cret"))
+}
+
+func TestBodyArgOption(t *testing.T) {
+	var path string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	type PathArg struct {
+		Id int `rc_feature:"path" rc_name:"id"`
+	}
+	type TestService struct {
+		Update func(*PathArg, map[string]string) ([]byte, error) `rc_method:"PUT" rc_path:"/users/{id}" rc_options:"body=1"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetMarshaler(&JsonMarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Update(&PathArg{Id: 3}, map[string]string{"name": "new"})
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/users/3")
+	assert.Equal(t, string(received), `{"name":"new"}`)
+}
+
+func TestBodyArgOptionInvalid(t *testing.T) {
+	type TestService struct {
+		Update func(string) ([]byte, error) `rc_method:"PUT" rc_options:"body=1"`
+	}
+
+	client, _ := NewBuilder().Build()
+	err := client.Init(&TestService{})
+	assert.Equal(t, err.Error(), "Invalid body argument: 1")
+}
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("1234"))
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		}
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Small func() ([]byte, error) `rc_method:"GET" rc_path:"/small"`
+		Large func() ([]byte, error) `rc_method:"GET" rc_path:"/large"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	for i := 0; i < 3; i++ {
+		_, err := service.Small()
+		assert.Nil(t, err)
+	}
+	_, err := service.Large()
+	assert.Nil(t, err)
+
+	stats := client.Stats()
+	assert.Equal(t, stats["Small"].Calls, int64(3))
+	assert.Equal(t, stats["Small"].Bytes, int64(12))
+	assert.Equal(t, stats["Large"].Calls, int64(1))
+	assert.Equal(t, stats["Large"].Bytes, int64(100))
+	assert.True(t, stats["Large"].Latency > 0)
+}
+
+func TestJoinPath(t *testing.T) {
+	assert.Equal(t, joinPath("", "/users"), "/users")
+	assert.Equal(t, joinPath("/v2", "/users"), "/v2/users")
+	assert.Equal(t, joinPath("/v2/", "/users"), "/v2/users")
+	assert.Equal(t, joinPath("v2", "users"), "/v2/users")
+	assert.Equal(t, joinPath("v2/", "users/1"), "/v2/users/1")
+	assert.Equal(t, joinPath("/v2", ""), "/v2")
+}
+
+func TestPathPrefix(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Users func() ([]byte, error) `rc_method:"GET" rc_path:"/users"`
+	}
+
+	for _, prefix := range []string{"/v2", "/v2/", "v2"} {
+		client, _ := NewBuilder().BaseUrl(server.URL).SetPathPrefix(prefix).Build()
+		service := &TestService{}
+		assert.Nil(t, client.Init(service))
+
+		_, err := service.Users()
+		assert.Nil(t, err)
+		assert.Equal(t, path, "/v2/users")
+	}
+}
+
+type statusRetryHandler struct {
+	attempts []int
+	waits    []time.Duration
+}
+
+func (h *statusRetryHandler) Retry(err error) error {
+	return err
+}
+
+func (h *statusRetryHandler) RetryWithContext(req *http.Request, resp *http.Response, attempt int, err error) (bool, time.Duration) {
+	h.attempts = append(h.attempts, attempt)
+	if err != nil || resp == nil || attempt >= 5 {
+		return false, 0
+	}
+
+	var wait time.Duration
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		wait = time.Millisecond
+	case http.StatusTooManyRequests:
+		wait = 10 * time.Millisecond
+	default:
+		return false, 0
+	}
+	h.waits = append(h.waits, wait)
+	return true, wait
+}
+
+func TestContextRetryHandler(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		status := statuses[0]
+		statuses = statuses[1:]
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Put func(*BodyArg) ([]byte, error) `rc_method:"PUT" rc_path:"/resource"`
+	}
+
+	handler := &statusRetryHandler{}
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetRetryHandler(handler).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Put(&BodyArg{Body: []byte("payload")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "OK")
+	assert.Equal(t, handler.attempts, []int{1, 2, 3})
+	assert.Equal(t, handler.waits, []time.Duration{time.Millisecond, 10 * time.Millisecond})
+	assert.Equal(t, bodies, []string{"payload", "payload", "payload"})
+}
+
+func TestFormEncoding(t *testing.T) {
+	var contentType, title, upload string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		upload = ""
+		if strings.HasPrefix(contentType, "multipart/form-data") {
+			r.ParseMultipartForm(1 << 20)
+			if file, header, err := r.FormFile("upload"); err == nil {
+				data, _ := ioutil.ReadAll(file)
+				upload = header.Filename + ":" + string(data)
+			}
+		} else {
+			r.ParseForm()
+		}
+		title = r.FormValue("title")
+	}))
+	defer server.Close()
+
+	type FormArgs struct {
+		Title string `rc_feature:"field" rc_name:"title"`
+	}
+	type UploadArgs struct {
+		Title  string    `rc_feature:"field" rc_name:"title"`
+		Upload io.Reader `rc_feature:"file" rc_name:"upload"`
+	}
+	type TestService struct {
+		Submit func(*FormArgs) ([]byte, error)   `rc_method:"POST" rc_path:"/submit"`
+		Upload func(*UploadArgs) ([]byte, error) `rc_method:"POST" rc_path:"/upload"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Submit(&FormArgs{Title: "fields only"})
+	assert.Nil(t, err)
+	assert.Equal(t, contentType, "application/x-www-form-urlencoded")
+	assert.Equal(t, title, "fields only")
+
+	_, err = service.Upload(&UploadArgs{Title: "with file", Upload: strings.NewReader("file contents")})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(contentType, "multipart/form-data; boundary="))
+	assert.Equal(t, title, "with file")
+	assert.Equal(t, upload, "upload:file contents")
+}
+
+type ClientError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *ClientError) Error() string { return fmt.Sprintf("client error %d", e.Status) }
+
+type ServerError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *ServerError) Error() string { return fmt.Sprintf("server error %d", e.Status) }
+
+func TestStatusErrorMapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("broken"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	type PathArg struct {
+		Path string `rc_feature:"path" rc_name:"path"`
+	}
+	type TestService struct {
+		Get func(*PathArg) ([]byte, error) `rc_method:"GET" rc_path:"/{path}"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetStatusErrorMapper(func(status int, body []byte, h http.Header) error {
+			switch {
+			case status >= 500:
+				return &ServerError{status, body}
+			case status >= 400:
+				return &ClientError{status, body}
+			}
+			return nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get(&PathArg{"found"})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "ok")
+
+	var clientErr *ClientError
+	_, err = service.Get(&PathArg{"missing"})
+	assert.True(t, errors.As(err, &clientErr))
+	assert.Equal(t, clientErr.Status, http.StatusNotFound)
+	assert.Equal(t, string(clientErr.Body), "not found")
+
+	var serverErr *ServerError
+	_, err = service.Get(&PathArg{"broken"})
+	assert.True(t, errors.As(err, &serverErr))
+	assert.Equal(t, serverErr.Status, http.StatusInternalServerError)
+	assert.Equal(t, string(serverErr.Body), "broken")
+}
+
+func TestCaptureExchanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("echo:"), body...))
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Echo func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/echo"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).CaptureExchanges(2).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	for _, body := range []string{"one", "two", "three"} {
+		_, err := service.Echo(&BodyArg{Body: []byte(body)})
+		assert.Nil(t, err)
+	}
+
+	exchanges := client.Exchanges()
+	assert.Len(t, exchanges, 2)
+	assert.Equal(t, exchanges[0].Method, "POST")
+	assert.Equal(t, exchanges[0].URL, server.URL+"/echo")
+	assert.Equal(t, string(exchanges[0].Request), "two")
+	assert.Equal(t, string(exchanges[1].Request), "three")
+	assert.Equal(t, exchanges[1].Status, http.StatusCreated)
+	assert.Equal(t, string(exchanges[1].Response), "echo:three")
+}
+
+func TestSetMethodDecoder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/odd" {
+			w.Write([]byte("name=odd"))
+			return
+		}
+		w.Write([]byte(`{"name":"json"}`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Odd    func() (*Thing, error) `rc_method:"GET" rc_path:"/odd"`
+		Normal func() (*Thing, error) `rc_method:"GET" rc_path:"/normal"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// Pointer returns are decoded into a *Thing, as with an Unmarshaler.
+	err := client.SetMethodDecoder(service, "Odd", func(data []byte, v interface{}) error {
+		v.(*Thing).Name = strings.TrimPrefix(string(data), "name=")
+		return nil
+	})
+	assert.Nil(t, err)
+
+	odd, err := service.Odd()
+	assert.Nil(t, err)
+	assert.Equal(t, odd.Name, "odd")
+
+	normal, err := service.Normal()
+	assert.Nil(t, err)
+	assert.Equal(t, normal.Name, "json")
+
+	err = client.SetMethodDecoder(service, "Missing", nil)
+	assert.ErrorIs(t, err, ErrUnknownMethod)
+}
+
+func TestMarshaledBodyContentLength(t *testing.T) {
+	var contentLength int64
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentLength = r.ContentLength
+		received, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type BodyArg struct {
+		Body *Thing `rc_feature:"body"`
+	}
+	type TestService struct {
+		Create func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetMarshaler(&JsonMarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Create(&BodyArg{Body: &Thing{Name: "widget"}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(received), `{"name":"widget"}`)
+	assert.Equal(t, contentLength, int64(len(received)))
+}
+
+func TestHeaderInjectionRejected(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type HeaderArg struct {
+		Token string `rc_feature:"header" rc_name:"X-Token"`
+	}
+	type TestService struct {
+		Get func(*HeaderArg) ([]byte, error) `rc_method:"GET" rc_path:"/"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get(&HeaderArg{Token: "abc\r\nX-Admin: true"})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.Equal(t, requests, 0)
+
+	_, err = service.Get(&HeaderArg{Token: "abc"})
+	assert.Nil(t, err)
+	assert.Equal(t, requests, 1)
+}
+
+type correlationIdKey struct{}
+
+func TestTransformerReadsContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Correlation-Id")))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func(context.Context, string) ([]byte, error) `rc_method:"GET" rc_path:"/things/{1}"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		AddRequestTransformer(func(r *http.Request) *http.Request {
+			if id, ok := r.Context().Value(correlationIdKey{}).(string); ok {
+				r.Header.Set("X-Correlation-Id", id)
+			}
+			return r
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	ctx := context.WithValue(context.Background(), correlationIdKey{}, "abc123")
+	body, err := service.Get(ctx, "widget")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/things/widget abc123")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = service.Get(ctx, "widget")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestHeaderOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/things/42")
+		w.Header().Add("Link", "</things?page=2>")
+		w.Header().Add("Link", "</things?page=9>")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	type CreateArgs struct {
+		Name     string    `rc_feature:"field" rc_name:"name"`
+		Location *string   `rc_feature:"header-out" rc_name:"Location"`
+		Links    *[]string `rc_feature:"header-out" rc_name:"Link"`
+	}
+	type TestService struct {
+		Create func(*CreateArgs) error `rc_method:"POST" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	args := &CreateArgs{Name: "widget"}
+	assert.Nil(t, service.Create(args))
+	assert.Equal(t, *args.Location, "/things/42")
+	assert.Equal(t, *args.Links, []string{"</things?page=2>", "</things?page=9>"})
+
+	type BadArgs struct {
+		Location string `rc_feature:"header-out" rc_name:"Location"`
+	}
+	type BadService struct {
+		Create func(*BadArgs) error `rc_method:"POST" rc_path:"/things"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrHeaderOutType)
+}
+
+func TestInterfaceReturn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/null" {
+			w.Write([]byte("null"))
+			return
+		}
+		w.Write([]byte(`{"name":"widget","tags":["a","b"]}`))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get  func() (interface{}, error) `rc_method:"GET" rc_path:"/thing"`
+		Null func() (interface{}, error) `rc_method:"GET" rc_path:"/null"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.IsType(t, thing, map[string]interface{}{})
+	assert.Equal(t, thing, map[string]interface{}{
+		"name": "widget",
+		"tags": []interface{}{"a", "b"},
+	})
+
+	null, err := service.Null()
+	assert.Nil(t, err)
+	assert.True(t, null == nil)
+}
+
+func snakeCase(goName string) string {
+	var b strings.Builder
+	for i, r := range goName {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func TestFieldNamer(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type SearchArgs struct {
+		UserId   int    `rc_feature:"query"`
+		PageSize int    `rc_feature:"query"`
+		Sort     string `rc_feature:"query" rc_name:"orderBy"`
+	}
+	type TestService struct {
+		Search func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search"`
+	}
+
+	assert.Equal(t, snakeCase("UserId"), "user_id")
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetFieldNamer(snakeCase).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Search(&SearchArgs{UserId: 7, PageSize: 20, Sort: "name"})
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{
+		"user_id":   {"7"},
+		"page_size": {"20"},
+		"orderBy":   {"name"},
+	})
+}
+
+func TestBudgetRetryHandler(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/flaky"`
+	}
+
+	// The second retry would wait 40ms and land past the 50ms budget, long before
+	// maxAttempts is reached.
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetRetryHandler(NewBudgetRetryHandler(50*time.Millisecond, 100, 20*time.Millisecond)).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	start := time.Now()
+	_, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(2))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestQueryStruct(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type Filter struct {
+		Status   string   `rc_name:"status"`
+		Owner    string   `rc_name:"owner" rc_options:"omitempty"`
+		Tags     []string `rc_name:"tag"`
+		MinPrice int      `rc_name:"min_price" rc_options:"omitempty"`
+	}
+	type SearchArgs struct {
+		Page   int     `rc_feature:"query" rc_name:"page"`
+		Filter *Filter `rc_feature:"querystruct"`
+	}
+	type TestService struct {
+		Search func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Search(&SearchArgs{
+		Page:   2,
+		Filter: &Filter{Status: "open", Tags: []string{"a", "b"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{
+		"page":   {"2"},
+		"status": {"open"},
+		"tag":    {"a", "b"},
+	})
+
+	// A nil filter adds nothing.
+	_, err = service.Search(&SearchArgs{Page: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{"page": {"3"}})
+
+	type BadArgs struct {
+		Filter string `rc_feature:"querystruct"`
+	}
+	type BadService struct {
+		Search func(*BadArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrQueryStructType)
+}
+
+func TestBaseUrlTrailingSlash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Users func() ([]byte, error) `rc_method:"GET" rc_path:"/users"`
+	}
+
+	for _, baseUrl := range []string{server.URL, server.URL + "/"} {
+		client, _ := NewBuilder().BaseUrl(baseUrl).Build()
+		service := &TestService{}
+		assert.Nil(t, client.Init(service))
+
+		path, err := service.Users()
+		assert.Nil(t, err)
+		assert.Equal(t, string(path), "/users")
+	}
+}
+
+type streamingUnmarshaler struct {
+	JsonUnmarshaler
+	streamed int
+}
+
+func (u *streamingUnmarshaler) UnmarshalReader(r io.Reader, obj interface{}) error {
+	u.streamed++
+	return u.JsonUnmarshaler.UnmarshalReader(r, obj)
+}
+
+func TestStreamingUnmarshal(t *testing.T) {
+	type Item struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	items := make([]Item, 50000)
+	for i := range items {
+		items[i] = Item{Id: i, Name: fmt.Sprintf("item-%d", i)}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(items)
+	}))
+	defer server.Close()
+
+	type OutArgs struct {
+		Items *[]Item `rc_feature:"out"`
+	}
+	type TestService struct {
+		List    func() ([]Item, error) `rc_method:"GET" rc_path:"/items"`
+		ListOut func(*OutArgs) error   `rc_method:"GET" rc_path:"/items"`
+		Head    func() (int64, error)  `rc_method:"HEAD" rc_path:"/items"`
+	}
+
+	unmarshaler := &streamingUnmarshaler{}
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(unmarshaler).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	list, err := service.List()
+	assert.Nil(t, err)
+	assert.Equal(t, list, items)
+	assert.Equal(t, unmarshaler.streamed, 1)
+
+	args := &OutArgs{}
+	assert.Nil(t, service.ListOut(args))
+	assert.Equal(t, *args.Items, items)
+	assert.Equal(t, unmarshaler.streamed, 2)
+
+	// HEAD lengths come from the response, not the body.
+	_, err = service.Head()
+	assert.Nil(t, err)
+	assert.Equal(t, unmarshaler.streamed, 2)
+}
+
+func TestStreamingUnmarshalTrailingData(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		A int `json:"a"`
+	}
+	type TestService struct {
+		Get func() (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body = `{"a":1}` + "\n  "
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, *thing, Thing{A: 1})
+
+	body = `{"a":1} not json`
+	_, err = service.Get()
+	assert.NotNil(t, err)
+
+	body = `{"a":1} {"a":2}`
+	_, err = service.Get()
+	assert.ErrorIs(t, err, ErrTrailingData)
+
+	// The whole body is read, trailing data included.
+	assert.Equal(t, client.Stats()["Get"].Bytes, int64(len(`{"a":1}`+"\n  "+`{"a":1} not json`+`{"a":1} {"a":2}`)))
+}
+
+func TestStaticHeaders(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type HeaderArg struct {
+		Accept string `rc_feature:"header" rc_name:"Accept" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Get func(*HeaderArg) ([]byte, error) `rc_method:"GET" rc_path:"/" rc_header:"X-Api-Version: 3" rc_header:"X-Feature: a" rc_header:"X-Feature: b" rc_header:"Accept: text/csv"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get(&HeaderArg{})
+	assert.Nil(t, err)
+	assert.Equal(t, headers.Get("X-Api-Version"), "3")
+	assert.Equal(t, headers["X-Feature"], []string{"a", "b"})
+	assert.Equal(t, headers.Get("Accept"), "text/csv")
+
+	// Header fields replace static headers of the same name.
+	_, err = service.Get(&HeaderArg{Accept: "application/json"})
+	assert.Nil(t, err)
+	assert.Equal(t, headers["Accept"], []string{"application/json"})
+
+	type BadService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/" rc_header:"NoColon"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrInvalidHeaderTag)
+}
+
+func TestBodyProviderRetry(t *testing.T) {
+	var attempts int32
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Upload func(func() (io.Reader, error)) ([]byte, error) `rc_method:"POST" rc_path:"/upload" rc_options:"idempotent"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetRetryHandler(&statusRetryHandler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	calls := 0
+	body, err := service.Upload(func() (io.Reader, error) {
+		calls++
+		return io.MultiReader(strings.NewReader("chunk-1,"), strings.NewReader("chunk-2")), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "ok")
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, received, []string{"chunk-1,chunk-2", "chunk-1,chunk-2"})
+
+	_, err = service.Upload(func() (io.Reader, error) {
+		return nil, errors.New("Unavailable")
+	})
+	assert.EqualError(t, err, "Upload: Unavailable")
+}
+
+var errNotFound = errors.New("Not found")
+
+func TestErrorNormalizer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such thing"))
+		case "/conflict":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("conflict"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func(string) ([]byte, error) `rc_method:"GET" rc_path:"/{0}"`
+	}
+
+	mapperCalled := false
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetStatusErrorMapper(func(status int, body []byte, h http.Header) error {
+			mapperCalled = true
+			return nil
+		}).
+		SetErrorNormalizer(func(status int, body []byte) error {
+			if status == http.StatusNotFound {
+				return fmt.Errorf("%w: %s", errNotFound, body)
+			}
+			return nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get("missing")
+	assert.ErrorIs(t, err, errNotFound)
+	assert.EqualError(t, err, "Get: Not found: no such thing")
+
+	// Statuses the normalizer passes on are decoded as usual.
+	body, err := service.Get("conflict")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "conflict")
+
+	body, err = service.Get("thing")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "ok")
+	assert.False(t, mapperCalled)
+}
+
+type color int
+
+func (c color) String() string {
+	return [...]string{"red", "green", "blue"}[c]
+}
+
+func TestVariadicQuery(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type SearchArgs struct {
+		Q string `rc_feature:"query" rc_name:"q"`
+	}
+	type TestService struct {
+		Search func(*SearchArgs, ...string) ([]byte, error) `rc_method:"GET" rc_path:"/search" rc_variadic:"tag"`
+		Colors func(...color) ([]byte, error)               `rc_method:"GET" rc_path:"/colors" rc_variadic:"color"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Search(&SearchArgs{Q: "shoes"}, "red", "sale", "new")
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{"q": {"shoes"}, "tag": {"red", "sale", "new"}})
+
+	_, err = service.Search(&SearchArgs{Q: "shoes"})
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{"q": {"shoes"}})
+
+	_, err = service.Colors(color(0), color(2))
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{"color": {"red", "blue"}})
+
+	type BadService struct {
+		Search func(...int) ([]byte, error) `rc_method:"GET" rc_path:"/search" rc_variadic:"n"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrVariadicType)
+}
+
+func TestIdempotentRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Create     func() ([]byte, error) `rc_method:"POST" rc_path:"/things"`
+		CreateSafe func() ([]byte, error) `rc_method:"POST" rc_path:"/things" rc_options:"idempotent"`
+		Update     func() ([]byte, error) `rc_method:"PUT" rc_path:"/things/1"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetRetryHandler(&statusRetryHandler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Create()
+	assert.Nil(t, err)
+	assert.Equal(t, atomic.SwapInt32(&attempts, 0), int32(1))
+
+	_, err = service.CreateSafe()
+	assert.Nil(t, err)
+	assert.Equal(t, atomic.SwapInt32(&attempts, 0), int32(5))
+
+	_, err = service.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, atomic.SwapInt32(&attempts, 0), int32(5))
+}
+
+func TestCookiesOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "xyz"})
+		w.Write([]byte("welcome"))
+	}))
+	defer server.Close()
+
+	type LoginArgs struct {
+		User    string         `rc_feature:"field" rc_name:"user"`
+		Cookies []*http.Cookie `rc_feature:"cookies-out"`
+	}
+	type TestService struct {
+		Login func(*LoginArgs) ([]byte, error) `rc_method:"POST" rc_path:"/login"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	args := &LoginArgs{User: "bob"}
+	body, err := service.Login(args)
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "welcome")
+	assert.Len(t, args.Cookies, 2)
+	assert.Equal(t, args.Cookies[0].Name, "session")
+	assert.Equal(t, args.Cookies[0].Value, "abc123")
+	assert.True(t, args.Cookies[0].HttpOnly)
+	assert.Equal(t, args.Cookies[1].Name, "csrf")
+
+	type BadArgs struct {
+		Cookies []http.Cookie `rc_feature:"cookies-out"`
+	}
+	type BadService struct {
+		Login func(*BadArgs) ([]byte, error) `rc_method:"POST" rc_path:"/login"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrCookiesOutType)
+}
+
+func TestRemoveRequestTransformer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header["X-Transformer"], ",")))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/"`
+	}
+
+	tagger := func(name string) RequestTransformer {
+		return func(r *http.Request) *http.Request {
+			r.Header.Add("X-Transformer", name)
+			return r
+		}
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).AddRequestTransformer(tagger("builder")).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	first := client.AddRequestTransformer(tagger("first"))
+	client.AddRequestTransformer(tagger("second"))
+
+	body, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "builder,first,second")
+
+	assert.True(t, client.RemoveRequestTransformer(first))
+	assert.False(t, client.RemoveRequestTransformer(first))
+
+	body, err = service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "builder,second")
+}
+
+func TestPercent20Query(t *testing.T) {
+	var rawQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type SearchArgs struct {
+		Q string `rc_feature:"query" rc_name:"q"`
+	}
+	type TestService struct {
+		Search        func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search"`
+		Search20      func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search" rc_options:"percent20"`
+		Search20Order func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search?v=a+b" rc_options:"percent20,orderedquery"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	args := &SearchArgs{Q: "red shoes+socks"}
+
+	_, err := service.Search(args)
+	assert.Nil(t, err)
+	assert.Equal(t, rawQuery, "q=red+shoes%2Bsocks")
+
+	_, err = service.Search20(args)
+	assert.Nil(t, err)
+	assert.Equal(t, rawQuery, "q=red%20shoes%2Bsocks")
+
+	// The path's own query is left alone.
+	_, err = service.Search20Order(args)
+	assert.Nil(t, err)
+	assert.Equal(t, rawQuery, "v=a+b&q=red%20shoes%2Bsocks")
+}
+
+func TestFallbackBaseUrl(t *testing.T) {
+	var primaryAttempts int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryAttempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("fallback " + r.URL.Path + "?" + r.URL.RawQuery + " " + string(body)))
+	}))
+	defer fallback.Close()
+
+	type PutArgs struct {
+		Id   int    `rc_feature:"path" rc_name:"id"`
+		V    string `rc_feature:"query" rc_name:"v"`
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Put func(*PutArgs) ([]byte, error) `rc_method:"PUT" rc_path:"/things/{id}"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(primary.URL).
+		SetPathPrefix("/v1").
+		SetRetryHandler(&statusRetryHandler{}).
+		SetFallbackBaseUrl(fallback.URL + "/").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Put(&PutArgs{Id: 4, V: "2", Body: []byte("data")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "fallback /v1/things/4?v=2 data")
+	assert.Equal(t, atomic.LoadInt32(&primaryAttempts), int32(5))
+
+	// A primary that can't be reached at all also falls back.
+	primary.Close()
+	body, err = service.Put(&PutArgs{Id: 5, Body: []byte("more")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "fallback /v1/things/5?v= more")
+}
+
+type ValidationErrors struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func (e *ValidationErrors) Error() string {
+	return fmt.Sprintf("%d invalid fields", len(e.Fields))
+}
+
+func TestSetErrorType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/invalid":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"fields":{"name":"required"}}`))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<html>oops</html>"))
+		default:
+			w.Write([]byte(`"ok"`))
+		}
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Create func(string) (string, error) `rc_method:"POST" rc_path:"/{0}"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetErrorType(&ValidationErrors{}, http.StatusUnprocessableEntity).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Create("invalid")
+	var validation *ValidationErrors
+	assert.True(t, errors.As(err, &validation))
+	assert.Equal(t, validation.Fields, map[string]string{"name": "required"})
+
+	_, err = service.Create("broken")
+	assert.ErrorIs(t, err, ErrUnexpectedStatus)
+	assert.EqualError(t, err, "Create: Unexpected status: 500")
+
+	result, err := service.Create("thing")
+	assert.Nil(t, err)
+	assert.Equal(t, result, "ok")
+}
+
+func TestBufferField(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("payload " + r.URL.Query().Get("n")))
+	}))
+	defer server.Close()
+
+	type FetchArgs struct {
+		N   int           `rc_feature:"query" rc_name:"n"`
+		Buf *bytes.Buffer `rc_feature:"buffer"`
+	}
+	type TestService struct {
+		Fetch func(*FetchArgs) error `rc_method:"GET" rc_path:"/fetch"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, service.Fetch(&FetchArgs{N: 1, Buf: buf}))
+	assert.Equal(t, buf.String(), "payload 1")
+
+	assert.Nil(t, service.Fetch(&FetchArgs{N: 22, Buf: buf}))
+	assert.Equal(t, buf.String(), "payload 22")
+
+	type BadArgs struct {
+		Buf []byte `rc_feature:"buffer"`
+	}
+	type BadService struct {
+		Fetch func(*BadArgs) error `rc_method:"GET" rc_path:"/fetch"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrBufferType)
+}
+
+func TestBodyTypeValidation(t *testing.T) {
+	type ChanBody struct {
+		Body chan int `rc_feature:"body"`
+	}
+	type StructBody struct {
+		Body map[string]int `rc_feature:"body"`
+	}
+	type ReaderBody struct {
+		Body io.Reader `rc_feature:"body"`
+	}
+	type ChanService struct {
+		Send func(*ChanBody) ([]byte, error) `rc_method:"POST" rc_path:"/"`
+	}
+	type ChanArgService struct {
+		Send func(chan int) ([]byte, error) `rc_method:"POST" rc_path:"/" rc_options:"body=0"`
+	}
+	type StructService struct {
+		Send func(*StructBody) ([]byte, error) `rc_method:"POST" rc_path:"/"`
+	}
+	type ReaderService struct {
+		Send func(*ReaderBody) ([]byte, error) `rc_method:"POST" rc_path:"/"`
+	}
+
+	client, _ := NewBuilder().SetMarshaler(&JsonMarshaler{}).Build()
+	assert.ErrorIs(t, client.Init(&ChanService{}), ErrUnsupportedBody)
+	assert.ErrorIs(t, client.Init(&ChanArgService{}), ErrUnsupportedBody)
+	assert.Nil(t, client.Init(&StructService{}))
+	assert.Nil(t, client.Init(&ReaderService{}))
+
+	// Without a marshaler, only raw bodies can be sent.
+	raw, _ := NewBuilder().Build()
+	assert.ErrorIs(t, raw.Init(&StructService{}), ErrNoMarshaler)
+	assert.Nil(t, raw.Init(&ReaderService{}))
+}
+
+func TestReaderBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	type ReaderBody struct {
+		Body io.Reader `rc_feature:"body"`
+	}
+	type TestService struct {
+		Send func(*ReaderBody) ([]byte, error) `rc_method:"POST" rc_path:"/"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Send(&ReaderBody{Body: strings.NewReader("streamed")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "streamed")
+}
+
+func TestBodyRetryCheck(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.Write([]byte(`{"retryable":true}`))
+			return
+		}
+		w.Write([]byte(`{"result":"done"}`))
+	}))
+	defer server.Close()
+
+	type Result struct {
+		Retryable bool   `json:"retryable"`
+		Result    string `json:"result"`
+	}
+	type TestService struct {
+		Get func() (*Result, error) `rc_method:"GET" rc_path:"/job"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetBodyRetryCheck(func(body []byte) bool {
+			var r Result
+			return json.Unmarshal(body, &r) == nil && r.Retryable
+		}, 5).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	result, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, result.Result, "done")
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(3))
+
+	// Once the retries run out, the last response is returned.
+	atomic.StoreInt32(&attempts, -10)
+	result, err = service.Get()
+	assert.Nil(t, err)
+	assert.True(t, result.Retryable)
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(-4))
+}
+
+func TestVariadicPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Parts  func(...string) ([]byte, error)      `rc_method:"GET" rc_path:"/{0}/{1}/{2}"`
+		Nested func(string, ...int) ([]byte, error) `rc_method:"GET" rc_path:"/{0}/items/{1}/{2}"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	path, err := service.Parts("a", "b", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, string(path), "/a/b/c")
+
+	path, err = service.Nested("repo", 4, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, string(path), "/repo/items/4/2")
+}
+
+func TestUseJsonTagNames(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type SearchArgs struct {
+		UserId   int    `rc_feature:"query" json:"user_id,omitempty"`
+		Sort     string `rc_feature:"query" json:"sort" rc_name:"order_by"`
+		PageSize int    `rc_feature:"query" json:"-"`
+		Cursor   string `rc_feature:"query"`
+	}
+	type TestService struct {
+		Search func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/search"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).UseJsonTagNames().SetFieldNamer(strings.ToLower).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Search(&SearchArgs{UserId: 7, Sort: "name", PageSize: 10, Cursor: "abc"})
+	assert.Nil(t, err)
+	assert.Equal(t, query, url.Values{
+		"user_id":  {"7"},
+		"order_by": {"name"},
+		"pagesize": {"10"},
+		"cursor":   {"abc"},
+	})
+}
+
+func TestSetProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Proxies are sent the absolute URL of the target.
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, err := NewBuilder().BaseUrl("http://api.example.invalid").SetProxy(proxy.URL).Build()
+	assert.Nil(t, err)
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "via proxy")
+	assert.Equal(t, proxied, []string{"http://api.example.invalid/things"})
+
+	_, err = NewBuilder().SetProxy("not a url").Build()
+	assert.ErrorIs(t, err, ErrInvalidProxy)
+}
+
+func TestContentTypeTag(t *testing.T) {
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body        []byte `rc_feature:"body"`
+		ContentType string `rc_feature:"header" rc_name:"Content-Type" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Create func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/things" rc_content_type:"application/vnd.api+json"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetDefaultContentType("application/json").Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Create(&BodyArg{Body: []byte("{}")})
+	assert.Nil(t, err)
+	assert.Equal(t, contentType, "application/vnd.api+json")
+
+	_, err = service.Create(&BodyArg{Body: []byte("{}"), ContentType: "text/plain"})
+	assert.Nil(t, err)
+	assert.Equal(t, contentType, "text/plain")
+}
+
+func TestNoUnmarshalerReturnType(t *testing.T) {
+	type Thing struct {
+		Name string
+	}
+	type OutArgs struct {
+		Thing *Thing `rc_feature:"out"`
+	}
+	type StructService struct {
+		Get func() (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+	type OutService struct {
+		Get func(*OutArgs) error `rc_method:"GET" rc_path:"/thing"`
+	}
+	type RawService struct {
+		Bytes  func() ([]byte, error)         `rc_method:"GET" rc_path:"/thing"`
+		Any    func() (interface{}, error)    `rc_method:"GET" rc_path:"/thing"`
+		Blob   func() (Blob, error)           `rc_method:"GET" rc_path:"/thing"`
+		Binary func() (*binaryMessage, error) `rc_method:"GET" rc_path:"/thing"`
+		Length func() (int64, error)          `rc_method:"HEAD" rc_path:"/thing"`
+	}
+
+	client, _ := NewBuilder().Build()
+
+	err := client.Init(&StructService{})
+	assert.ErrorIs(t, err, ErrNoReturnUnmarshaler)
+	assert.EqualError(t, err, "No unmarshaler configured for non-[]byte return: *reflectclient.Thing")
+	assert.ErrorIs(t, client.Init(&OutService{}), ErrNoReturnUnmarshaler)
+	assert.Nil(t, client.Init(&RawService{}))
+
+	withUnmarshaler, _ := NewBuilder().SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	assert.Nil(t, withUnmarshaler.Init(&StructService{}))
+}
+
+func TestMultipleFeatures(t *testing.T) {
+	var path, header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, header = r.URL.Path, r.Header.Get("X-Tenant-Id")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	type TenantArgs struct {
+		Tenant string `rc_feature:"path,header" rc_name:"tenant,X-Tenant-Id"`
+		Id     string `rc_feature:"path,query" rc_name:"id"`
+	}
+	type TestService struct {
+		Get func(*TenantArgs) ([]byte, error) `rc_method:"GET" rc_path:"/tenants/{tenant}/things/{id}"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get(&TenantArgs{Tenant: "acme", Id: "42"})
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/tenants/acme/things/42")
+	assert.Equal(t, header, "acme")
+
+	// Spaces after the commas are ignored.
+	type SpacedArgs struct {
+		Tenant string `rc_feature:"path, header" rc_name:"tenant, X-Tenant-Id"`
+	}
+	type SpacedService struct {
+		Get func(*SpacedArgs) ([]byte, error) `rc_method:"GET" rc_path:"/tenants/{tenant}"`
+	}
+	spaced := &SpacedService{}
+	assert.Nil(t, client.Init(spaced))
+
+	_, err = spaced.Get(&SpacedArgs{Tenant: "acme"})
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/tenants/acme")
+	assert.Equal(t, header, "acme")
+
+	type BadArgs struct {
+		Tenant string `rc_feature:"path,heder" rc_name:"tenant"`
+	}
+	type BadService struct {
+		Get func(*BadArgs) ([]byte, error) `rc_method:"GET" rc_path:"/tenants/{tenant}"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrUnknownFeature)
+}
+
+func TestValidateService(t *testing.T) {
+	type PathArgs struct {
+		Id string `rc_feature:"path" rc_name:"id"`
+	}
+	type BadMethodService struct {
+		Get  func(*PathArgs) ([]byte, error) `rc_method:"GET" rc_path:"/things/{id}"`
+		Call func() ([]byte, error)          `rc_method:"FETCH"`
+	}
+	type BadPathService struct {
+		Get func(*PathArgs) ([]byte, error) `rc_method:"GET" rc_path:"/things/{thing}"`
+	}
+	type GoodService struct {
+		Get  func(*PathArgs) ([]byte, error) `rc_method:"GET" rc_path:"/things/{id}"`
+		List func(string) ([]byte, error)    `rc_method:"GET" rc_path:"/things?owner={0}"`
+	}
+
+	client, _ := NewBuilder().Build()
+
+	service := &BadMethodService{}
+	err := client.ValidateService(service)
+	assert.True(t, errors.Is(err, ErrUnsupportedMethod))
+	assert.Nil(t, service.Get)
+	assert.Equal(t, client.Init(&BadMethodService{}), err)
+
+	err = client.ValidateService(&BadPathService{})
+	assert.True(t, errors.Is(err, ErrUnknownPathToken))
+	assert.Equal(t, client.Init(&BadPathService{}), err)
+
+	good := &GoodService{}
+	assert.Nil(t, client.ValidateService(good))
+	assert.Nil(t, good.Get)
+	assert.Nil(t, client.Init(good))
+}
+
+func TestContextBaseUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default " + r.URL.Path))
+	}))
+	defer server.Close()
+	tenant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tenant " + r.URL.Path))
+	}))
+	defer tenant.Close()
+
+	type TestService struct {
+		Get func(context.Context, string) ([]byte, error) `rc_method:"GET" rc_path:"/things/{1}"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get(context.Background(), "widget")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "default /things/widget")
+
+	body, err = service.Get(WithBaseUrl(context.Background(), tenant.URL), "widget")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "tenant /things/widget")
+}
+
+func TestIterator(t *testing.T) {
+	pages := map[string]string{
+		"":  `{"items": [{"id": 1}, {"id": 2}], "next": "b"}`,
+		"b": `{"items": [], "next": "c"}`,
+		"c": `{"items": [{"id": 3}], "next": ""}`,
+	}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		w.Write([]byte(pages[r.URL.Query().Get("page")]))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Id int `json:"id"`
+	}
+	type ListArgs struct {
+		Owner string `rc_feature:"query" rc_name:"owner"`
+	}
+	type TestService struct {
+		List func(*ListArgs) (*Iterator[Thing], error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetCursorExtractor(func(resp *http.Response, body []byte) ([]byte, string, error) {
+			var page struct {
+				Items json.RawMessage `json:"items"`
+				Next  string          `json:"next"`
+			}
+			err := json.Unmarshal(body, &page)
+			return page.Items, page.Next, err
+		}).
+		SetRequestRebuilder(func(req *http.Request, cursor string) (*http.Request, error) {
+			next := req.Clone(req.Context())
+			query := next.URL.Query()
+			query.Set("page", cursor)
+			next.URL.RawQuery = query.Encode()
+			return next, nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	it, err := service.List(&ListArgs{Owner: "me"})
+	assert.Nil(t, err)
+	assert.Equal(t, len(requests), 0)
+
+	var ids []int
+	for {
+		thing, ok, err := it.Next()
+		assert.Nil(t, err)
+		if !ok {
+			break
+		}
+		ids = append(ids, thing.Id)
+	}
+	assert.Equal(t, ids, []int{1, 2, 3})
+	assert.Equal(t, requests, []string{"owner=me", "owner=me&page=b", "owner=me&page=c"})
+
+	_, ok, err := it.Next()
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
+
+func TestIteratorPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		if r.Header.Get("X-Signature") != r.URL.RawQuery || len(r.Header.Values("X-Transformed")) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if cursor == "b" && r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if cursor == "" {
+			w.Header().Set("X-Next", "b")
+			w.Write([]byte(`[{"id": 1}]`))
+			return
+		}
+		w.Write([]byte(`[{"id": 2}]`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Id int `json:"id"`
+	}
+	type TestService struct {
+		List func(context.Context) (*Iterator[Thing], error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	token := "old"
+	var statuses []int
+	var observed []map[string]interface{}
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetCursorExtractor(func(resp *http.Response, body []byte) ([]byte, string, error) {
+			return body, resp.Header.Get("X-Next"), nil
+		}).
+		AddRequestTransformer(func(r *http.Request) *http.Request {
+			r.Header.Add("X-Transformed", "1")
+			r.Header.Set("Authorization", "Bearer "+token)
+			return r
+		}).
+		SetRequestSigner(func(r *http.Request, body []byte) error {
+			r.Header.Set("X-Signature", r.URL.RawQuery)
+			return nil
+		}).
+		SetUnauthorizedHandler(func(ctx context.Context) error {
+			token = "new"
+			return nil
+		}).
+		SetMetricsObserver(func(ctx context.Context, method string, status int, elapsed time.Duration, err error) {
+			statuses = append(statuses, status)
+			observed = append(observed, Metadata(ctx))
+		}).
+		CaptureExchanges(10).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// Every page is transformed and signed afresh, and goes through the unauthorized handler,
+	// the metrics observer and exchange capture like any other request.
+	it, err := service.List(WithMetadata(context.Background(), "list", "things"))
+	assert.Nil(t, err)
+	var ids []int
+	for {
+		thing, ok, err := it.Next()
+		assert.Nil(t, err)
+		if !ok {
+			break
+		}
+		ids = append(ids, thing.Id)
+	}
+	assert.Equal(t, ids, []int{1, 2})
+	assert.Equal(t, token, "new")
+	assert.Equal(t, statuses, []int{http.StatusOK, http.StatusOK})
+	md := map[string]interface{}{"list": "things"}
+	assert.Equal(t, observed, []map[string]interface{}{md, md})
+
+	exchanges := client.Exchanges()
+	assert.Equal(t, len(exchanges), 2)
+	if len(exchanges) == 2 {
+		assert.Equal(t, exchanges[0].URL, server.URL+"/things")
+		assert.Equal(t, exchanges[1].URL, server.URL+"/things?cursor=b")
+		assert.Equal(t, string(exchanges[1].Response), `[{"id": 2}]`)
+	}
+	assert.Equal(t, client.Stats()["List"].Calls, int64(2))
+}
+
+func TestIteratorTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte(`[{"id": 1}, {"id": 2}]`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Id int `json:"id"`
+	}
+	type ListArgs struct {
+		Slow bool `rc_feature:"query" rc_name:"slow" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		List func(*ListArgs, *CallOptions) (*Iterator[Thing], error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// The timeout covers the pages fetched after List returns.
+	it, err := service.List(&ListArgs{}, &CallOptions{Timeout: 5 * time.Second})
+	assert.Nil(t, err)
+	thing, ok, err := it.Next()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, thing.Id, 1)
+
+	it, err = service.List(&ListArgs{Slow: true}, &CallOptions{Timeout: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	_, ok, err = it.Next()
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRawField(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 42, "name": "widget"}`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+		Raw  []byte `json:"-" rc_feature:"raw"`
+	}
+	type TestService struct {
+		Get    func() (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+		GetVal func() (Thing, error)  `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, thing.Id, 42)
+	assert.Equal(t, thing.Name, "widget")
+	assert.Equal(t, string(thing.Raw), `{"id": 42, "name": "widget"}`)
+
+	value, err := service.GetVal()
+	assert.Nil(t, err)
+	assert.Equal(t, value.Name, "widget")
+	assert.Equal(t, string(value.Raw), `{"id": 42, "name": "widget"}`)
+
+	type BadThing struct {
+		Raw string `rc_feature:"raw"`
+	}
+	type BadService struct {
+		Get func() (*BadThing, error) `rc_method:"GET"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrRawType)
+}
+
+func TestDialTimeout(t *testing.T) {
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/"`
+	}
+
+	// 10.255.255.1 is unroutable, so the dial hangs until it times out.
+	client, _ := NewBuilder().BaseUrl("http://10.255.255.1").SetDialTimeout(100 * time.Millisecond).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	start := time.Now()
+	_, err := service.Get()
+	var netErr net.Error
+	if err != nil && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+		t.Skipf("dial failed without hanging on this host: %v", err)
+	}
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// Accept connections but never answer the TLS handshake, holding each open until the
+	// test is done.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl("https://" + listener.Addr().String()).
+		SetTLSHandshakeTimeout(100 * time.Millisecond).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	start := time.Now()
+	_, err = service.Get()
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestDynamicQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func(string) ([]byte, error) `rc_method:"GET" rc_path:"/things?id={0}"`
+	}
+
+	regions := []string{"us-east", "eu-west", ""}
+	calls := 0
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		AddDynamicQuery("region", func() string {
+			region := regions[calls]
+			calls++
+			return region
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get("1")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "id=1&region=us-east")
+
+	body, err = service.Get("2")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "id=2&region=eu-west")
+
+	body, err = service.Get("3")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "id=3")
+}
+
+func TestMethodOverride(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.Header.Get("X-HTTP-Method-Override") + " " + string(body)))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Patch func([]byte) ([]byte, error) `rc_method:"PATCH" rc_path:"/things/1" rc_options:"body=0"`
+		Get   func() ([]byte, error)       `rc_method:"GET" rc_path:"/things/1"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).EnableMethodOverride().Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Patch([]byte("name=widget"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "POST PATCH name=widget")
+
+	body, err = service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "GET  ")
+}
+
+func TestStatusCodeReturn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Create func() (int, error) `rc_method:"POST" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	status, err := service.Create()
+	assert.Nil(t, err)
+	assert.Equal(t, status, http.StatusCreated)
+}
+
+func TestMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"thing"}`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get    func(context.Context) (*Thing, error)         `rc_method:"GET" rc_path:"/things"`
+		Create func(context.Context, *Thing) (*Thing, error) `rc_method:"POST" rc_path:"/things" rc_options:"body=1"`
+	}
+
+	var transformed, logged, observed, decoded []map[string]interface{}
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetMarshaler(&JsonMarshaler{}).
+		AddRequestTransformer(func(r *http.Request) *http.Request {
+			transformed = append(transformed, Metadata(r.Context()))
+			return r
+		}).
+		SetBodyLogger(func(ctx context.Context, method string, body []byte) {
+			logged = append(logged, Metadata(ctx))
+		}).
+		SetMetricsObserver(func(ctx context.Context, method string, status int, elapsed time.Duration, err error) {
+			observed = append(observed, Metadata(ctx))
+		}).
+		SetDecodeObserver(func(ctx context.Context, method string, v interface{}) {
+			decoded = append(decoded, Metadata(ctx))
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	ctx := WithMetadata(context.Background(), "tenant", "acme")
+	ctx = WithMetadata(ctx, "attempt", 2)
+	_, err := service.Create(ctx, &Thing{Name: "thing"})
+	assert.Nil(t, err)
+
+	_, err = service.Get(context.Background())
+	assert.Nil(t, err)
+
+	md := map[string]interface{}{"tenant": "acme", "attempt": 2}
+	assert.Equal(t, transformed, []map[string]interface{}{md, nil})
+	assert.Equal(t, logged, []map[string]interface{}{md})
+	assert.Equal(t, observed, []map[string]interface{}{md, nil})
+	assert.Equal(t, decoded, []map[string]interface{}{md, nil})
+}
+
+func TestOmitEmptyStructBody(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	type Patch struct {
+		Name string `json:"name,omitempty"`
+	}
+	type UpdateArgs struct {
+		Patch Patch `rc_feature:"body" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Update func(*UpdateArgs) ([]byte, error) `rc_method:"PATCH" rc_path:"/things/1"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetMarshaler(&JsonMarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Update(&UpdateArgs{})
+	assert.Nil(t, err)
+	_, err = service.Update(&UpdateArgs{Patch: Patch{Name: "widget"}})
+	assert.Nil(t, err)
+	assert.Equal(t, bodies, []string{"", `{"name":"widget"}`})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyingRetryHandler(t *testing.T) {
+	var attempts int
+	var failure error
+	httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, failure
+	})}
+
+	type TestService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl("http://example.test").
+		SetHttpClient(httpClient).
+		SetRetryHandler(NewClassifyingRetryHandler(3, time.Millisecond, nil)).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	failure = &net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}
+	_, err := service.Get()
+	assert.NotNil(t, err)
+	assert.Equal(t, attempts, 1)
+
+	attempts = 0
+	failure = timeoutError{}
+	_, err = service.Get()
+	assert.NotNil(t, err)
+	assert.Equal(t, attempts, 3)
+
+	assert.Equal(t, ClassifyError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), ErrorConnectionRefused)
+	assert.Equal(t, ClassifyError(&net.DNSError{IsTemporary: true}), ErrorTemporaryDNS)
+	assert.Equal(t, ClassifyError(context.Canceled), ErrorPermanent)
+}
+
+func TestRangeField(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	type DownloadArgs struct {
+		Range *ByteRange `rc_feature:"range"`
+	}
+	type TestService struct {
+		Download func(*DownloadArgs) ([]byte, error) `rc_method:"GET" rc_path:"/file.txt"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Download(&DownloadArgs{Range: &ByteRange{Start: 2, End: 5}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "2345")
+
+	body, err = service.Download(&DownloadArgs{Range: &ByteRange{Start: 7, End: -1}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "789")
+
+	body, err = service.Download(&DownloadArgs{})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "0123456789")
+
+	body, err = service.Download(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "0123456789")
+
+	body, err = service.Download(&DownloadArgs{Range: &ByteRange{}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "0")
+
+	type ValueArgs struct {
+		Range ByteRange `rc_feature:"range"`
+	}
+	type ValueService struct {
+		Download func(*ValueArgs) ([]byte, error) `rc_method:"GET" rc_path:"/file.txt"`
+	}
+	valueService := &ValueService{}
+	assert.Nil(t, client.Init(valueService))
+
+	body, err = valueService.Download(&ValueArgs{})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "0123456789")
+
+	body, err = valueService.Download(&ValueArgs{Range: ByteRange{Start: 8, End: 9}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "89")
+
+	type BadArgs struct {
+		Range string `rc_feature:"range"`
+	}
+	type BadService struct {
+		Download func(*BadArgs) ([]byte, error) `rc_method:"GET"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrRangeType)
+}
+
+// Stands in for a generated protobuf message, which only the pointer type implements.
+type protoPoint struct {
+	X, Y int32
+}
+
+func (p *protoPoint) Marshal() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(p.X))
+	binary.BigEndian.PutUint32(data[4:], uint32(p.Y))
+	return data, nil
+}
+
+func (p *protoPoint) Unmarshal(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("bad message")
+	}
+	p.X = int32(binary.BigEndian.Uint32(data))
+	p.Y = int32(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+type protoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// Adapts protoMessage to Marshaler and Unmarshaler, as a protobuf codec would.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a message", v)
+	}
+	return m.Marshal()
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a message", v)
+	}
+	return m.Unmarshal(data)
+}
+
+func TestProtoCodec(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	type PointArgs struct {
+		Point *protoPoint `rc_feature:"body"`
+	}
+	type TestService struct {
+		Echo func(*PointArgs) (*protoPoint, error) `rc_method:"POST" rc_path:"/echo"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetMarshaler(protoCodec{}).SetUnmarshaler(protoCodec{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	point, err := service.Echo(&PointArgs{Point: &protoPoint{X: 3, Y: -4}})
+	assert.Nil(t, err)
+	assert.Equal(t, point, &protoPoint{X: 3, Y: -4})
+
+	// A per-method decoder gets the same *protoPoint the codec does.
+	assert.Nil(t, client.SetMethodDecoder(service, "Echo", protoCodec{}.Unmarshal))
+	point, err = service.Echo(&PointArgs{Point: &protoPoint{X: 5, Y: 6}})
+	assert.Nil(t, err)
+	assert.Equal(t, point, &protoPoint{X: 5, Y: 6})
+}
+
+func TestRequiredField(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	type GetArgs struct {
+		Id      string `rc_feature:"path" rc_name:"id" rc_options:"required"`
+		Version string `rc_feature:"query" rc_name:"version" rc_options:"omitempty,required"`
+	}
+	type TestService struct {
+		Get func(*GetArgs) ([]byte, error) `rc_method:"GET" rc_path:"/things/{id}"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get(&GetArgs{Version: "2"})
+	assert.ErrorIs(t, err, ErrRequiredField)
+	assert.Equal(t, err.Error(), "Get: Required field is empty: Id")
+
+	_, err = service.Get(&GetArgs{Id: "42"})
+	assert.ErrorIs(t, err, ErrRequiredField)
+	assert.Contains(t, err.Error(), "Version")
+
+	_, err = service.Get(nil)
+	assert.ErrorIs(t, err, ErrRequiredField)
+	assert.Equal(t, requests, 0)
+
+	body, err := service.Get(&GetArgs{Id: "42", Version: "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/things/42")
+}
+
+func TestRawQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Raw     func() ([]byte, error) `rc_method:"GET" rc_path:"/search?q=a%2Bb&sort=name,-date&z=1&a=2" rc_options:"rawquery"`
+		Encoded func() ([]byte, error) `rc_method:"GET" rc_path:"/search?q=a%2Bb&sort=name,-date&z=1&a=2"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Raw()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "q=a%2Bb&sort=name,-date&z=1&a=2")
+
+	body, err = service.Encoded()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "a=2&q=a%2Bb&sort=name%2C-date&z=1")
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	var accepted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get("Accept-Encoding")
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(`{"name":"gzipped"}`))
+			gz.Close()
+			return
+		}
+		// Hex stands in for brotli, which the standard library can't encode.
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte(hex.EncodeToString([]byte(`{"name":"widget"}`))))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get  func() (*Thing, error) `rc_method:"GET" rc_path:"/br"`
+		Gzip func() (*Thing, error) `rc_method:"GET" rc_path:"/gzip"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		RegisterDecoder("br", func(r io.Reader) (io.Reader, error) {
+			return hex.NewDecoder(r), nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, thing.Name, "widget")
+	assert.Equal(t, accepted, "gzip, br")
+
+	thing, err = service.Gzip()
+	assert.Nil(t, err)
+	assert.Equal(t, thing.Name, "gzipped")
+}
+
+func TestDefaultCharset(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Content-Type")))
+	}))
+	defer server.Close()
+
+	type JsonArgs struct {
+		Body map[string]string `rc_feature:"body"`
+	}
+	type TestService struct {
+		Text   func(string) ([]byte, error)    `rc_method:"POST" rc_path:"/text" rc_options:"body=0"`
+		Latin1 func([]byte) ([]byte, error)    `rc_method:"POST" rc_path:"/text" rc_options:"body=0,charset=iso-8859-1"`
+		Json   func(*JsonArgs) ([]byte, error) `rc_method:"POST" rc_path:"/json"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetMarshaler(&JsonMarshaler{}).
+		SetDefaultContentType("text/plain").
+		SetDefaultCharset("utf-8").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Text("hello")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "text/plain; charset=utf-8")
+
+	body, err = service.Latin1([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "text/plain; charset=iso-8859-1")
+
+	body, err = service.Json(&JsonArgs{Body: map[string]string{"a": "b"}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "text/plain")
+}
+
+func TestOptionalPathSegment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	type ItemArgs struct {
+		Id string `rc_feature:"path" rc_name:"id"`
+	}
+	type TestService struct {
+		Items   func(*ItemArgs) ([]byte, error) `rc_method:"GET" rc_path:"/items{/id}"`
+		Version func(string) ([]byte, error)    `rc_method:"GET" rc_path:"/docs{/0}/index"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Items(&ItemArgs{Id: "42"})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/items/42")
+
+	body, err = service.Items(&ItemArgs{})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/items")
+
+	body, err = service.Version("v2")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/docs/v2/index")
+
+	body, err = service.Version("")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/docs/index")
+}
+
+func TestDecodeObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "widget"}`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get func() (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	var method string
+	var decoded interface{}
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		SetDecodeObserver(func(ctx context.Context, m string, v interface{}) {
+			method, decoded = m, v
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, method, "Get")
+	assert.True(t, decoded.(*Thing) == thing)
+}
+
+func TestDecodeObserverSingleFlight(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte(`{"name": "widget"}`))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get func(context.Context) (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	var mu sync.Mutex
+	observed := make(map[interface{}]bool)
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		EnableSingleFlight().
+		SetDecodeObserver(func(ctx context.Context, m string, v interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			observed[Metadata(ctx)["caller"]] = true
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	// Callers sharing a response each see their own context, not the leader's.
+	const calls = 5
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := service.Get(WithMetadata(context.Background(), "caller", i))
+			assert.Nil(t, err)
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&hits), int32(1))
+	assert.Equal(t, observed, map[interface{}]bool{0: true, 1: true, 2: true, 3: true, 4: true})
+}
+
+func TestNDJSONChunked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cut" {
+			// Send one full line and part of another, then drop the connection.
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+			buf.WriteString("b\r\n{\"line\":1}\n\r\n")
+			buf.WriteString("5\r\n{\"lin\r\n")
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "{\"line\":%d}\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	type LogLine struct {
+		Line int `json:"line"`
+	}
+	type TestService struct {
+		Tail func(func(LogLine) error) ([]byte, error) `rc_method:"GET" rc_path:"/logs"`
+		Cut  func(func(LogLine) error) ([]byte, error) `rc_method:"GET" rc_path:"/cut"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	var lines []int
+	_, err := service.Tail(func(line LogLine) error {
+		lines = append(lines, line.Line)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, lines, []int{1, 2, 3})
+
+	lines = nil
+	_, err = service.Cut(func(line LogLine) error {
+		lines = append(lines, line.Line)
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrStreamInterrupted)
+	assert.Equal(t, lines, []int{1})
+}
+
+func TestQueryExpander(t *testing.T) {
+	type TimeRange struct {
+		From, To time.Time
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	type SearchArgs struct {
+		Range TimeRange  `rc_feature:"query" rc_name:"range"`
+		Other *TimeRange `rc_feature:"query" rc_name:"other"`
+		Q     string     `rc_feature:"query" rc_name:"q"`
+	}
+	type TestService struct {
+		Search func(*SearchArgs) ([]byte, error) `rc_method:"GET" rc_path:"/events" rc_options:"orderedquery"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		RegisterQueryExpander(reflect.TypeOf(TimeRange{}), func(v reflect.Value, q url.Values) {
+			r := v.Interface().(TimeRange)
+			q.Set("from", r.From.Format("2006-01-02"))
+			q.Set("to", r.To.Format("2006-01-02"))
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Search(&SearchArgs{
+		Range: TimeRange{
+			From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+		},
+		Q: "deploy",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "from=2024-01-01&to=2024-01-31&q=deploy")
+}
+
+func TestJSONNumber(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 9007199254740993}`))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Get func() (map[string]interface{}, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetJSONNumber().Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, thing["id"], json.Number("9007199254740993"))
+
+	client, _ = NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	assert.Nil(t, client.Init(service))
+
+	thing, err = service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, thing["id"], float64(9007199254740993))
+}
+
+func TestYaml(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != ContentTypeYaml {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name  string `yaml:"name" json:"-"`
+		Count int    `yaml:"count" json:"-"`
+	}
+	type EchoArgs struct {
+		Thing *Thing `rc_feature:"body"`
+	}
+	type TestService struct {
+		Echo func(*EchoArgs) (*Thing, error) `rc_method:"POST" rc_path:"/echo" rc_content_type:"application/yaml"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetMarshaler(&YamlMarshaler{}).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		RegisterUnmarshaler(ContentTypeYaml, &YamlUnmarshaler{}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	thing, err := service.Echo(&EchoArgs{Thing: &Thing{Name: "widget", Count: 3}})
+	assert.Nil(t, err)
+	assert.Equal(t, thing, &Thing{Name: "widget", Count: 3})
+}
+
+func TestHeaderOutSplit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Feature-Flags", "a,b, c")
+		w.Header().Add("X-Feature-Flags", "d")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	type FlagArgs struct {
+		Flags *[]string `rc_feature:"header-out" rc_name:"X-Feature-Flags" rc_options:"split"`
+		Raw   *[]string `rc_feature:"header-out" rc_name:"X-Feature-Flags"`
+	}
+	type TestService struct {
+		Flags func(*FlagArgs) error `rc_method:"GET" rc_path:"/flags"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	args := &FlagArgs{}
+	assert.Nil(t, service.Flags(args))
+	assert.Equal(t, *args.Flags, []string{"a", "b", "c", "d"})
+	assert.Equal(t, *args.Raw, []string{"a,b, c", "d"})
+}
+
+func TestBodyLogger(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer server.Close()
+
+	type Login struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	type LoginArgs struct {
+		Login Login `rc_feature:"body"`
+	}
+	type TestService struct {
+		Login func(*LoginArgs) ([]byte, error) `rc_method:"POST" rc_path:"/login"`
+	}
+
+	var method, logged, redacted string
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetMarshaler(&JsonMarshaler{}).
+		SetBodyLogger(func(ctx context.Context, m string, body []byte) {
+			method, logged = m, string(body)
+			redacted = string(RedactJSONFields(body, "Password"))
+			body[0] = 'X'
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Login(&LoginArgs{Login: Login{User: "ann", Password: "hunter2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, method, "Login")
+	assert.Equal(t, logged, `{"user":"ann","password":"hunter2"}`)
+	assert.Equal(t, redacted, `{"password":"[REDACTED]","user":"ann"}`)
+	assert.Equal(t, received, `{"user":"ann","password":"hunter2"}`)
+
+	assert.Equal(t, string(RedactJSONFields([]byte("not json"), "password")), "not json")
+	assert.Equal(t, string(RedactJSONFields([]byte(`[{"token":"abc","n":12345678901234567890}]`), "token")),
+		`[{"n":12345678901234567890,"token":"[REDACTED]"}]`)
+}
+
+func TestServicePathPrefix(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	type UserService struct {
+		_   struct{}                     `rc_path:"/users"`
+		Get func(string) ([]byte, error) `rc_method:"GET" rc_path:"/{0}"`
+	}
+	type OrderService struct {
+		_    struct{}               `rc_path:"/orders"`
+		List func() ([]byte, error) `rc_method:"GET"`
+	}
+	type Api struct {
+		_ struct{} `rc_path:"/v1"`
+		UserService
+		*OrderService
+		Health func() ([]byte, error) `rc_method:"GET" rc_path:"/health"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	api := &Api{}
+	assert.Nil(t, client.ValidateService(api))
+	assert.Nil(t, client.Init(api))
+
+	body, err := api.Get("42")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/v1/users/42")
+
+	body, err = api.List()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/v1/orders")
+
+	body, err = api.Health()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/v1/health")
+
+	users := &UserService{}
+	assert.Nil(t, client.Init(users))
+	body, err = users.Get("7")
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "/users/7")
+
+	// Methods are registered by name, so embedded services can't share one.
+	type AccountService struct {
+		_   struct{}                     `rc_path:"/accounts"`
+		Get func(string) ([]byte, error) `rc_method:"GET" rc_path:"/{0}"`
+	}
+	type Clashing struct {
+		UserService
+		AccountService
+	}
+	assert.ErrorIs(t, client.ValidateService(&Clashing{}), ErrDuplicateMethod)
+	assert.ErrorIs(t, client.Init(&Clashing{}), ErrDuplicateMethod)
+}
+
+func TestDefaultHeaderForMethods(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Prefer")))
+	}))
+	defer server.Close()
+
+	type PreferArgs struct {
+		Prefer string `rc_feature:"header" rc_name:"Prefer"`
+	}
+	type TestService struct {
+		Get    func() ([]byte, error)            `rc_method:"GET" rc_path:"/things/1"`
+		Create func() ([]byte, error)            `rc_method:"POST" rc_path:"/things"`
+		Update func(*PreferArgs) ([]byte, error) `rc_method:"PATCH" rc_path:"/things/1"`
+	}
+
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		AddDefaultHeaderForMethods("Prefer", "return=representation", "post", "PUT", "PATCH").
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "")
+
+	body, err = service.Create()
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "return=representation")
+
+	body, err = service.Update(&PreferArgs{Prefer: "return=minimal"})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "return=minimal")
+}
+
+func TestCallOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte(r.Header.Get("X-Request-Id")))
+	}))
+	defer server.Close()
+
+	type GetArgs struct {
+		Slow bool `rc_feature:"query" rc_name:"slow" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Get func(*GetArgs, *CallOptions) ([]byte, error) `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Get(&GetArgs{}, &CallOptions{Header: http.Header{"X-Request-Id": {"abc"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "abc")
+
+	body, err = service.Get(&GetArgs{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "")
+
+	start := time.Now()
+	_, err = service.Get(&GetArgs{Slow: true}, &CallOptions{Timeout: 50 * time.Millisecond})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestUnauthorizedHandler(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	type BodyArg struct {
+		Body []byte `rc_feature:"body"`
+	}
+	type TestService struct {
+		Post func(*BodyArg) ([]byte, error) `rc_method:"POST" rc_path:"/things"`
+	}
+
+	token := "stale"
+	refreshes := 0
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		AddRequestTransformer(func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+token)
+			return r
+		}).
+		SetUnauthorizedHandler(func(ctx context.Context) error {
+			refreshes++
+			token = "fresh"
+			return nil
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	body, err := service.Post(&BodyArg{Body: []byte("payload")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "payload")
+	assert.Equal(t, requests, 2)
+	assert.Equal(t, refreshes, 1)
+
+	// Failed refreshes leave the 401 as is.
+	token = "stale"
+	requests = 0
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		AddRequestTransformer(func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+token)
+			return r
+		}).
+		SetUnauthorizedHandler(func(ctx context.Context) error { return errors.New("no refresh token") }).
+		Build()
+	assert.Nil(t, client.Init(service))
+
+	body, err = service.Post(&BodyArg{Body: []byte("payload")})
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), "")
+	assert.Equal(t, requests, 1)
+}
+
+func TestIndexedFormFields(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	type Item struct {
+		Name string `rc_name:"name"`
+		Qty  int    `rc_name:"qty"`
+	}
+	type OrderArgs struct {
+		Customer string  `rc_feature:"field" rc_name:"customer"`
+		Items    []Item  `rc_feature:"field" rc_name:"items"`
+		Extras   []*Item `rc_feature:"field" rc_name:"extras" rc_options:"omitempty"`
+	}
+	type TestService struct {
+		Order func(*OrderArgs) ([]byte, error) `rc_method:"POST" rc_path:"/orders"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Order(&OrderArgs{
+		Customer: "ada",
+		Items:    []Item{{Name: "tea", Qty: 2}, {Name: "cake", Qty: 1}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, form, url.Values{
+		"customer":       {"ada"},
+		"items[0][name]": {"tea"},
+		"items[0][qty]":  {"2"},
+		"items[1][name]": {"cake"},
+		"items[1][qty]":  {"1"},
+	})
+
+	_, err = service.Order(&OrderArgs{Items: []Item{}, Extras: []*Item{nil, {Name: "jam"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, form, url.Values{
+		"customer":        {""},
+		"extras[1][name]": {"jam"},
+		"extras[1][qty]":  {"0"},
+	})
+}
+
+func TestMaxBodyOption(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 64))
+	}))
+	defer server.Close()
+
+	type TestService struct {
+		Small func() ([]byte, error) `rc_method:"GET" rc_path:"/small" rc_options:"maxbody=16"`
+		Exact func() ([]byte, error) `rc_method:"GET" rc_path:"/exact" rc_options:"maxbody=64"`
+		Large func() ([]byte, error) `rc_method:"GET" rc_path:"/large"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Small()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	body, err := service.Exact()
+	assert.Nil(t, err)
+	assert.Equal(t, len(body), 64)
+
+	body, err = service.Large()
+	assert.Nil(t, err)
+	assert.Equal(t, len(body), 64)
+
+	type BadService struct {
+		Get func() ([]byte, error) `rc_method:"GET" rc_path:"/" rc_options:"maxbody=lots"`
+	}
+	assert.NotNil(t, client.Init(&BadService{}))
+}
+
+func TestRequestIDs(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Request-Id")
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	type Thing struct {
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get func(*CallOptions) (*Thing, error) `rc_method:"GET" rc_path:"/thing"`
+	}
+
+	ids := 0
+	client, _ := NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		EnableRequestIDs("X-Request-Id", func() string {
+			ids++
+			return fmt.Sprintf("req-%d", ids)
+		}).
+		Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	_, err := service.Get(nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, received, "req-1")
+	assert.True(t, strings.Contains(err.Error(), "(request id req-1)"))
+
+	_, err = service.Get(&CallOptions{Header: http.Header{"X-Request-Id": {"caller"}}})
+	assert.Equal(t, received, "caller")
+	assert.True(t, strings.Contains(err.Error(), "(request id caller)"))
+
+	client, _ = NewBuilder().
+		BaseUrl(server.URL).
+		SetUnmarshaler(&JsonUnmarshaler{}).
+		EnableRequestIDs("X-Request-Id", nil).
+		Build()
+	assert.Nil(t, client.Init(service))
+
+	_, err = service.Get(nil)
+	assert.Equal(t, len(received), 32)
+	assert.True(t, strings.Contains(err.Error(), "(request id "+received+")"))
+}
+
+type celsius float64
+
+func (c celsius) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%.1fC", float64(c))), nil
+}
+
+type badText struct{}
+
+func (badText) MarshalText() ([]byte, error) { return nil, errors.New("cannot encode") }
+
+func TestTextMarshalerFormFields(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	type ReadingArgs struct {
+		Temp    celsius   `rc_feature:"field" rc_name:"temp"`
+		History []celsius `rc_feature:"field" rc_name:"history"`
+		Taken   time.Time `rc_feature:"field" rc_name:"taken"`
+	}
+	type BadArgs struct {
+		Value badText `rc_feature:"field" rc_name:"value"`
+	}
+	type TestService struct {
+		Record func(*ReadingArgs) ([]byte, error) `rc_method:"POST" rc_path:"/readings"`
+		Bad    func(*BadArgs) ([]byte, error)     `rc_method:"POST" rc_path:"/readings"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	taken := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	_, err := service.Record(&ReadingArgs{Temp: 21.5, History: []celsius{19, 20.25}, Taken: taken})
+	assert.Nil(t, err)
+	assert.Equal(t, form, url.Values{
+		"temp":    {"21.5C"},
+		"history": {"19.0C", "20.2C"},
+		"taken":   {"2024-03-01T12:00:00Z"},
+	})
+
+	_, err = service.Bad(&BadArgs{})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "cannot encode"))
+}
+
+func TestStatusReturn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{"id":7,"name":"user"}`))
+	}))
+	defer server.Close()
+
+	type User struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	type TestService struct {
+		Get     func() (*User, int, error) `rc_method:"GET" rc_path:"/user"`
+		Missing func() (*User, int, error) `rc_method:"GET" rc_path:"/missing"`
+	}
+
+	client, _ := NewBuilder().BaseUrl(server.URL).SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	user, status, err := service.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, *user, User{Id: 7, Name: "user"})
+
+	_, status, err = service.Missing()
+	assert.Nil(t, err)
+	assert.Equal(t, status, http.StatusNotFound)
+
+	type BadService struct {
+		Get func() (*User, string, error) `rc_method:"GET" rc_path:"/user"`
+	}
+	assert.ErrorIs(t, client.Init(&BadService{}), ErrStatusReturn)
+}
+
+func TestStubMethod(t *testing.T) {
+	type Thing struct {
+		Name string
+	}
+	type TestService struct {
+		Get  func(int) (*Thing, error) `rc_method:"GET" rc_path:"/things/{0}"`
+		List func() ([]byte, error)    `rc_method:"GET" rc_path:"/things"`
+	}
+
+	client, _ := NewBuilder().BaseUrl("http://localhost:0").SetUnmarshaler(&JsonUnmarshaler{}).Build()
+	service := &TestService{}
+	assert.Nil(t, client.Init(service))
+
+	var got int
+	err := client.StubMethod(service, "Get", func(id int) (*Thing, error) {
+		got = id
+		return &Thing{Name: "stubbed"}, nil
+	})
+	assert.Nil(t, err)
+
+	thing, err := service.Get(3)
+	assert.Nil(t, err)
+	assert.Equal(t, *thing, Thing{Name: "stubbed"})
+	assert.Equal(t, got, 3)
+
+	err = client.StubMethod(service, "List", func() (string, error) { return "", nil })
+	assert.ErrorIs(t, err, ErrStubType)
+	err = client.StubMethod(service, "Missing", func() error { return nil })
+	assert.ErrorIs(t, err, ErrUnknownMethod)
+
+	// Get is ambiguous between the embedded structs, so it can't be stubbed.
+	type Labels struct {
+		Get string
+	}
+	type Ambiguous struct {
+		TestService
+		Labels
+	}
+	ambiguous := &Ambiguous{}
+	assert.Nil(t, client.Init(ambiguous))
+	err = client.StubMethod(ambiguous, "Get", func(id int) (*Thing, error) { return nil, nil })
+	assert.ErrorIs(t, err, ErrUnknownMethod)
+}
+
+func TestWebSocketInit(t *testing.T) {
+	type WebSocketStruct struct {
+		WSRequest func() (*websocket.Conn, error) `rc_method:"GET" origin:"https://www.websocket.org" path:"/echo"`
+	}
+
+	client, _ := NewBuilder().Build()
+	service := &WebSocketStruct{}
+
+	err := client.Init(service)
+	assert.Nil(t, err)
+}
+
+func TestWebSocketArgErrors(t *testing.T) {
+	type Args struct {
+		Token string `rc_feature:"header" rc_name:"X-Token"`
+	}
+	type WebSocketStruct struct {
+		WSRequest func(*Args) (*websocket.Conn, error) `rc_method:"GET" rc_path:"/echo"`
+	}
+
+	client, _ := NewBuilder().BaseUrl("ws://localhost:0").Build()
+	service := &WebSocketStruct{}
+	assert.Nil(t, client.Init(service))
+
+	conn, err := service.WSRequest(&Args{Token: "a\r\nInjected: b"})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.True(t, conn == nil)
+}
+
+func TestJSONConn(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer server.Close()
+
+	type Message struct {
+		Text  string `json:"text"`
+		Count int    `json:"count"`
+	}
+	type WebSocketStruct struct {
+		Echo func() (*websocket.Conn, error) `rc_method:"GET" rc_origin:"http://localhost" rc_path:"/echo"`
+	}
+
+	client, _ := NewBuilder().BaseUrl("ws" + strings.TrimPrefix(server.URL, "http")).Build()
+	service := &WebSocketStruct{}
+	assert.Nil(t, client.Init(service))
+
+	conn, err := service.Echo()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	jc := client.NewJSONConn(conn)
+	assert.Nil(t, jc.Send(&Message{Text: "hello", Count: 2}))
+
+	var received Message
+	assert.Nil(t, jc.Receive(&received))
+	assert.Equal(t, received, Message{Text: "hello", Count: 2})
 }
 
 func TestWebSocketConnect(t *testing.T) {
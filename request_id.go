@@ -0,0 +1,27 @@
+package reflectclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+)
+
+// Generate a random 128 bit request ID, hex encoded.
+func randomRequestId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Add the request ID to the error in rvals, if there is one. Errors returned as a custom
+// error type are left alone, since wrapping would change their type.
+func (m *MethodMeta) withRequestId(rvals []reflect.Value, id string) []reflect.Value {
+	errIdx := len(rvals) - 1
+	if m.errorType != errorType || rvals[errIdx].IsNil() {
+		return rvals
+	}
+	err := rvals[errIdx].Interface().(error)
+	rvals[errIdx] = m.errorValue(fmt.Errorf("%w (request id %s)", err, id))
+	return rvals
+}
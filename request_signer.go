@@ -0,0 +1,7 @@
+package reflectclient
+
+import (
+	"net/http"
+)
+
+type RequestSigner func(req *http.Request, body []byte) error
@@ -4,4 +4,48 @@ import (
 	"net/http"
 )
 
+// Modify a request before it is sent. Transformers apply to every method, but they can
+// read per-call values from r.Context() when the method takes a context.Context argument:
+//
+//	GetUser func(context.Context, int) (*User, error) `rc_method:"GET" rc_path:"/user/{1}"`
 type RequestTransformer func(r *http.Request) *http.Request
+
+// Identifies a transformer added with Client.AddRequestTransformer, so it can be removed.
+type TransformerHandle struct {
+	id uint64
+}
+
+type registeredTransformer struct {
+	id          uint64
+	transformer RequestTransformer
+}
+
+// Add a transformer after those already registered, including any added with
+// Builder.AddRequestTransformer. Transformers run in the order they were added.
+func (c *Client) AddRequestTransformer(transformer RequestTransformer) TransformerHandle {
+	c.transformersMu.Lock()
+	defer c.transformersMu.Unlock()
+
+	c.lastTransformerId++
+	transformers := make([]registeredTransformer, len(c.requestTransformers), len(c.requestTransformers)+1)
+	copy(transformers, c.requestTransformers)
+	c.requestTransformers = append(transformers, registeredTransformer{c.lastTransformerId, transformer})
+	return TransformerHandle{c.lastTransformerId}
+}
+
+// Remove a transformer added with AddRequestTransformer. Returns false if it isn't
+// registered.
+func (c *Client) RemoveRequestTransformer(handle TransformerHandle) bool {
+	c.transformersMu.Lock()
+	defer c.transformersMu.Unlock()
+
+	for i, t := range c.requestTransformers {
+		if t.id == handle.id {
+			transformers := make([]registeredTransformer, 0, len(c.requestTransformers)-1)
+			transformers = append(transformers, c.requestTransformers[:i]...)
+			c.requestTransformers = append(transformers, c.requestTransformers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
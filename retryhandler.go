@@ -1,9 +1,33 @@
 package reflectclient
 
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
 type RetryHandler interface {
 	Retry(error) error
 }
 
+// A RetryHandler that is consulted after every attempt with the request, the response
+// (nil on transport errors) and the attempt number, starting at 1. It returns whether to
+// retry and how long to wait first. When a handler implements this, Retry is not used.
+type ContextRetryHandler interface {
+	RetryHandler
+	RetryWithContext(req *http.Request, resp *http.Response, attempt int, err error) (bool, time.Duration)
+}
+
+// A RetryHandler that is also told how long has passed since the first attempt started.
+// When a handler implements this, RetryWithContext and Retry are not used.
+type TimedRetryHandler interface {
+	RetryHandler
+	RetryWithElapsed(req *http.Request, resp *http.Response, attempt int, elapsed time.Duration, err error) (bool, time.Duration)
+}
+
 type BasicRetryHandler struct {
 	maxRetries int
 	retryCount int
@@ -19,3 +43,110 @@ func (h *BasicRetryHandler) Retry(err error) error {
 	}
 	return err
 }
+
+// Retries transport errors and 5xx responses with exponential backoff until either
+// maxAttempts have been made or the next attempt would start after the time budget.
+type BudgetRetryHandler struct {
+	budget      time.Duration
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewBudgetRetryHandler(budget time.Duration, maxAttempts int, backoff time.Duration) *BudgetRetryHandler {
+	return &BudgetRetryHandler{budget, maxAttempts, backoff}
+}
+
+func (h *BudgetRetryHandler) Retry(err error) error {
+	return err
+}
+
+func (h *BudgetRetryHandler) RetryWithElapsed(req *http.Request, resp *http.Response, attempt int, elapsed time.Duration, err error) (bool, time.Duration) {
+	if err == nil && resp.StatusCode < 500 {
+		return false, 0
+	}
+	if attempt >= h.maxAttempts {
+		return false, 0
+	}
+	wait := h.backoff << uint(attempt-1)
+	if elapsed+wait > h.budget {
+		return false, 0
+	}
+	return true, wait
+}
+
+// The kind of a transport error, used to decide whether it's worth retrying.
+type ErrorClass int
+
+const (
+	ErrorPermanent         ErrorClass = iota // Retrying won't help, e.g. an unknown host
+	ErrorTimeout                             // The dial, handshake or request timed out
+	ErrorConnectionRefused                   // Nothing was listening, e.g. while a server restarts
+	ErrorTemporaryDNS                        // DNS lookup failed, but not because the host doesn't exist
+)
+
+// Whether errors of the class are worth retrying.
+func (c ErrorClass) Transient() bool {
+	return c != ErrorPermanent
+}
+
+// Classifies a transport error.
+type ErrorClassifier func(err error) ErrorClass
+
+// The default ErrorClassifier. Errors from the caller's context ending are permanent,
+// since a retry would fail the same way.
+func ClassifyError(err error) ErrorClass {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorPermanent
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return ErrorPermanent
+		}
+		if dnsErr.IsTimeout {
+			return ErrorTimeout
+		}
+		if dnsErr.IsTemporary {
+			return ErrorTemporaryDNS
+		}
+		return ErrorPermanent
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorConnectionRefused
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorTimeout
+	}
+	return ErrorPermanent
+}
+
+// Retries transport errors that its ErrorClassifier finds transient, with exponential
+// backoff, until maxAttempts have been made. Responses, including 5xx, aren't retried.
+type ClassifyingRetryHandler struct {
+	maxAttempts int
+	backoff     time.Duration
+	classifier  ErrorClassifier
+}
+
+// A nil classifier uses ClassifyError.
+func NewClassifyingRetryHandler(maxAttempts int, backoff time.Duration, classifier ErrorClassifier) *ClassifyingRetryHandler {
+	if classifier == nil {
+		classifier = ClassifyError
+	}
+	return &ClassifyingRetryHandler{maxAttempts, backoff, classifier}
+}
+
+func (h *ClassifyingRetryHandler) Retry(err error) error {
+	return err
+}
+
+func (h *ClassifyingRetryHandler) RetryWithContext(req *http.Request, resp *http.Response, attempt int, err error) (bool, time.Duration) {
+	if err == nil || attempt >= h.maxAttempts || !h.classifier(err).Transient() {
+		return false, 0
+	}
+	return true, h.backoff << uint(attempt-1)
+}
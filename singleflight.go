@@ -0,0 +1,55 @@
+package reflectclient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+)
+
+// A response read by one request and shared with every caller waiting on the same key.
+type sharedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// Return the key a request is coalesced under, or "" if it isn't.
+func (c *Client) sharedKey(req *http.Request) string {
+	if c.singleFlight == nil {
+		return ""
+	}
+	if c.coalesceKey != nil {
+		return c.coalesceKey(req)
+	}
+	if req.Method == "GET" {
+		return req.URL.String()
+	}
+	return ""
+}
+
+// Send a request through the client's singleflight group. Every caller gets its own copy
+// of the response and its headers, with a fresh reader over the shared body.
+func (c *Client) doShared(req *http.Request, key string, idempotent bool) (*http.Response, error) {
+	v, err, _ := c.singleFlight.Do(key, func() (interface{}, error) {
+		resp, err := c.do(req, idempotent)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedResponse{resp, body}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared := v.(*sharedResponse)
+	resp := *shared.resp
+	resp.Header = shared.resp.Header.Clone()
+	resp.Trailer = shared.resp.Trailer.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(shared.body))
+	return &resp, nil
+}
@@ -0,0 +1,49 @@
+package reflectclient
+
+import (
+	"io"
+	"time"
+)
+
+// Running totals for the calls made through a service method.
+type MethodStats struct {
+	Calls   int64
+	Bytes   int64         // Response body bytes read
+	Latency time.Duration // Total time spent in calls
+}
+
+// Return a snapshot of the stats for every method called through this client, keyed
+// by method name.
+func (c *Client) Stats() map[string]MethodStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	stats := make(map[string]MethodStats, len(c.stats))
+	for name, s := range c.stats {
+		stats[name] = s
+	}
+	return stats
+}
+
+func (c *Client) recordStats(meta *MethodMeta, bytes int64, elapsed time.Duration) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	s := c.stats[meta.name]
+	s.Calls++
+	s.Bytes += bytes
+	s.Latency += elapsed
+	c.stats[meta.name] = s
+}
+
+// Counts the bytes read from a response body.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,7 @@
+package reflectclient
+
+import (
+	"net/http"
+)
+
+type StatusErrorMapper func(status int, body []byte, h http.Header) error
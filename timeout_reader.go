@@ -0,0 +1,41 @@
+package reflectclient
+
+import (
+	"io"
+	"time"
+)
+
+// A reader that fails any Read that takes longer than timeout, closing the underlying
+// body so the stalled read is released.
+type timeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	// Read into our own buffer so a read that finishes after the timeout can't write
+	// into p behind the caller's back.
+	buf := make([]byte, len(p))
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.body.Read(buf)
+		done <- readResult{n, err}
+	}()
+
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		copy(p, buf[:result.n])
+		return result.n, result.err
+	case <-timer.C:
+		r.body.Close()
+		return 0, ErrReadTimeout
+	}
+}
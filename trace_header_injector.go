@@ -0,0 +1,8 @@
+package reflectclient
+
+import (
+	"context"
+	"net/http"
+)
+
+type TraceHeaderInjector func(ctx context.Context, h http.Header)
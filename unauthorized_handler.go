@@ -0,0 +1,51 @@
+package reflectclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Called when a request gets a 401. Returning nil means auth was refreshed, and the request
+// is sent once more, with request transformers and the signer applied again.
+type UnauthorizedHandler func(ctx context.Context) error
+
+// Apply request transformers, trace headers and the signer to req.
+func (c *Client) prepareRequest(req *http.Request, body []byte) (*http.Request, error) {
+	req = c.applyRequestTransformers(req)
+
+	if c.traceHeaderInjector != nil {
+		c.traceHeaderInjector(req.Context(), req.Header)
+	}
+
+	if c.requestSigner != nil {
+		if err := c.requestSigner(req, append([]byte(nil), body...)); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// Let the unauthorized handler refresh auth, then send unauthed, prepared again, one more
+// time. If the handler fails, the original 401 response is returned untouched.
+func (c *Client) retryUnauthorized(unauthed *http.Request, body []byte, resp *http.Response, idempotent bool) (*http.Response, error) {
+	if err := c.unauthorizedHandler(unauthed.Context()); err != nil {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := unauthed.Clone(unauthed.Context())
+	if unauthed.GetBody != nil {
+		var err error
+		if retry.Body, err = unauthed.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry, err := c.prepareRequest(retry, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(retry, idempotent)
+}
@@ -1,16 +1,61 @@
 package reflectclient
 
 import (
+	"bytes"
 	"encoding/json"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
 )
 
 type Unmarshaler interface {
 	Unmarshal([]byte, interface{}) error
 }
 
+// An Unmarshaler that can decode straight from a response body. When the configured
+// Unmarshaler implements this, responses with a single destination aren't buffered first.
+type ReaderUnmarshaler interface {
+	Unmarshaler
+	UnmarshalReader(io.Reader, interface{}) error
+}
+
 type JsonUnmarshaler struct {
+	// Decode numbers into interface{} values as json.Number rather than float64, so large
+	// integers keep their precision.
+	UseNumber bool
 }
 
 func (u *JsonUnmarshaler) Unmarshal(in []byte, obj interface{}) error {
+	if u.UseNumber {
+		return u.UnmarshalReader(bytes.NewReader(in), obj)
+	}
 	return json.Unmarshal(in, obj)
 }
+
+// Decode a single JSON value from r. Like json.Unmarshal, anything but whitespace after the
+// value is an error. r is read to the end either way.
+func (u *JsonUnmarshaler) UnmarshalReader(r io.Reader, obj interface{}) error {
+	defer io.Copy(ioutil.Discard, r)
+
+	decoder := json.NewDecoder(r)
+	if u.UseNumber {
+		decoder.UseNumber()
+	}
+	if err := decoder.Decode(obj); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			err = ErrTrailingData
+		}
+		return err
+	}
+	return nil
+}
+
+type YamlUnmarshaler struct {
+}
+
+func (u *YamlUnmarshaler) Unmarshal(in []byte, obj interface{}) error {
+	return yaml.Unmarshal(in, obj)
+}
@@ -1,10 +1,33 @@
 package reflectclient
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+var bodyProviderType = reflect.TypeOf((func() (io.Reader, error))(nil))
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+var bytesType = reflect.TypeOf([]byte(nil))
+var intType = reflect.TypeOf(0)
+
+// Whether a body value is sent as is as text, i.e. a string or []byte.
+func isTextBody(v reflect.Value) bool {
+	return v.IsValid() && (v.Kind() == reflect.String || v.Type() == bytesType)
+}
+
 func in(needle string, haystack []string) bool {
 	for _, s := range haystack {
 		if s == needle {
@@ -18,6 +41,30 @@ func extractFieldValue(value reflect.Value, name string) string {
 	return fmt.Sprint(value.FieldByName(name).Interface())
 }
 
+// Format a query, form or header value, using its MarshalText method if it has one.
+func formatValue(value reflect.Value) (string, error) {
+	if m, ok := textMarshaler(value); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	return fmt.Sprint(value.Interface()), nil
+}
+
+// The encoding.TextMarshaler implemented by value, or by a pointer to it if it's addressable.
+func textMarshaler(value reflect.Value) (encoding.TextMarshaler, bool) {
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return nil, false
+	}
+	if m, ok := value.Interface().(encoding.TextMarshaler); ok {
+		return m, true
+	}
+	if value.CanAddr() {
+		m, ok := value.Addr().Interface().(encoding.TextMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
 func elementType(in reflect.Type) reflect.Type {
 	// TODO: At some point this should support other types I guess...
 	if in.Kind() == reflect.Ptr {
@@ -32,3 +79,195 @@ func elementValue(in reflect.Value) reflect.Value {
 	}
 	return in
 }
+
+func isRepeatable(value reflect.Value) bool {
+	return (value.Kind() == reflect.Slice || value.Kind() == reflect.Array) &&
+		value.Type().Elem().Kind() != reflect.Uint8
+}
+
+// Allocate a value of type typ and return it with its encoding.BinaryUnmarshaler, if
+// either the type or a pointer to it implements one.
+func newBinaryUnmarshaler(typ reflect.Type) (reflect.Value, encoding.BinaryUnmarshaler, bool) {
+	if typ.Kind() == reflect.Ptr {
+		value := reflect.New(typ.Elem())
+		u, ok := value.Interface().(encoding.BinaryUnmarshaler)
+		return value, u, ok
+	}
+	value := reflect.New(typ)
+	u, ok := value.Interface().(encoding.BinaryUnmarshaler)
+	return value.Elem(), u, ok
+}
+
+// url.Values that remembers the order in which keys were first added.
+type orderedValues struct {
+	url.Values
+	keys []string
+}
+
+func newOrderedValues() *orderedValues {
+	return &orderedValues{Values: url.Values{}}
+}
+
+func (v *orderedValues) Add(key, value string) {
+	if _, ok := v.Values[key]; !ok {
+		v.keys = append(v.keys, key)
+	}
+	v.Values.Add(key, value)
+}
+
+func (v *orderedValues) Del(key string) {
+	if _, ok := v.Values[key]; !ok {
+		return
+	}
+	for i, k := range v.keys {
+		if k == key {
+			v.keys = append(v.keys[:i], v.keys[i+1:]...)
+			break
+		}
+	}
+	v.Values.Del(key)
+}
+
+// Like url.Values.Encode, but keys are encoded in insertion order instead of sorted.
+func (v *orderedValues) Encode() string {
+	var buf strings.Builder
+	for _, k := range v.keys {
+		for _, value := range v.Values[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(value))
+		}
+	}
+	return buf.String()
+}
+
+func gzipBytes(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Extract the error from an error-typed return value, treating typed nils as nil.
+func returnedError(value reflect.Value) error {
+	if isEmptyValue(value) {
+		return nil
+	}
+	err, _ := value.Interface().(error)
+	return err
+}
+
+// Split a comma separated header (which may be repeated) into its trimmed, non-empty values.
+func splitHeader(h http.Header, name string) []string {
+	values := make([]string, 0)
+	for _, line := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// Rewrite a query encoded by url.QueryEscape so spaces are %20 instead of +. Literal
+// plus signs are already escaped as %2B, so every + is a space.
+func percent20(encoded string) string {
+	return strings.ReplaceAll(encoded, "+", "%20")
+}
+
+// Join a base URL and a path with exactly one slash between them, so "http://host/" and
+// "/users" don't become "http://host//users".
+func joinUrl(base, path string) string {
+	if path == "" || strings.HasPrefix(path, "?") {
+		return base + path
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// Join a path prefix and a path with exactly one slash between them.
+func joinPath(prefix, path string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix == "" {
+		return path
+	}
+	if path == "" {
+		return "/" + prefix
+	}
+	return "/" + prefix + "/" + strings.TrimLeft(path, "/")
+}
+
+// Sleep for d, returning early with the context's error if it is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= 200 && status <= 299
+}
+
+// Return every value of key in tag. reflect.StructTag.Get only returns the first, but some
+// tags (rc_header) can be repeated. This follows the parsing in reflect.StructTag.Lookup.
+func tagValues(tag reflect.StructTag, key string) []string {
+	var values []string
+	for tag != "" {
+		// Skip leading space.
+		i := 0
+		for i < len(tag) && tag[i] == ' ' {
+			i++
+		}
+		tag = tag[i:]
+		if tag == "" {
+			break
+		}
+
+		// Scan to colon. A space, a quote or a control character is a syntax error.
+		i = 0
+		for i < len(tag) && tag[i] > ' ' && tag[i] != ':' && tag[i] != '"' && tag[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(tag) || tag[i] != ':' || tag[i+1] != '"' {
+			break
+		}
+		name := string(tag[:i])
+		tag = tag[i+1:]
+
+		// Scan quoted string to find value.
+		i = 1
+		for i < len(tag) && tag[i] != '"' {
+			if tag[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(tag) {
+			break
+		}
+		qvalue := string(tag[:i+1])
+		tag = tag[i+1:]
+
+		if name == key {
+			if value, err := strconv.Unquote(qvalue); err == nil {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}